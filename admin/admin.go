@@ -0,0 +1,61 @@
+// Package admin implements service http listener (metrics, admin API, etc ...)
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/afoninsky/verdite/httpproxy"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server ...
+type Server struct {
+	proxy  *httpproxy.Proxy
+	router *httprouter.Router
+	// hides secret configuration values in responses
+	redact func(string) string
+}
+
+// New ...
+func New(proxy *httpproxy.Proxy, redact func(string) string) *Server {
+	s := Server{
+		proxy:  proxy,
+		redact: redact,
+	}
+	s.router = &httprouter.Router{}
+	s.router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
+	s.router.HandlerFunc(http.MethodGet, "/api/circuit-breakers", s.circuitBreakers)
+	s.router.HandlerFunc(http.MethodGet, "/ready", s.ready)
+	return &s
+}
+
+// Handler returns admin http handler
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+func (s *Server) circuitBreakers(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, s.proxy.CircuitBreakers())
+}
+
+// ready reports readiness to accept traffic, it fails once shutdown is started
+func (s *Server) ready(w http.ResponseWriter, r *http.Request) {
+	if !s.proxy.Ready() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, data interface{}) {
+	body, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, s.redact(string(body))+"\n")
+}
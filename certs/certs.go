@@ -0,0 +1,206 @@
+// Package certs implements TLS configuration for the proxy listener:
+// 	- certificate is selected by SNI (exact name, then wildcard, then the first one)
+// 	- certificates and client CA bundle are reloaded when files change
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+// Store keeps actual certificates
+type Store struct {
+	cfg        config.ListenerTLS
+	log        *logger.Logger
+	clientAuth tls.ClientAuthType
+
+	mu      sync.RWMutex
+	byName  map[string]*tls.Certificate
+	first   *tls.Certificate
+	clients *x509.CertPool
+	stamps  map[string]time.Time
+}
+
+// New loads certificates and starts watching them for changes
+func New(cfg config.ListenerTLS, log *logger.Logger) (*Store, error) {
+	s := Store{
+		cfg: cfg,
+		log: log,
+	}
+	if len(cfg.Certificates) == 0 {
+		return nil, errors.New("no certificates specified")
+	}
+
+	switch cfg.ClientAuth {
+	case "", "none":
+		s.clientAuth = tls.NoClientCert
+	case "request":
+		s.clientAuth = tls.RequestClientCert
+	case "verify-if-given":
+		s.clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		s.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unsupported client auth mode: %s", cfg.ClientAuth)
+	}
+	if s.clientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCA == "" {
+		return nil, fmt.Errorf(`client auth "%s" requires client CA bundle`, cfg.ClientAuth)
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	interval := cfg.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	go s.watch(interval)
+
+	return &s, nil
+}
+
+// TLSConfig returns listener configuration, every handshake uses actual certificates
+func (s *Store) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.GetCertificate = s.getCertificate
+		c.ClientAuth = s.clientAuth
+		c.ClientCAs = s.clients
+		return c, nil
+	}
+	return base
+}
+
+// getCertificate picks certificate matching SNI
+func (s *Store) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.first, nil
+}
+
+// load reads all files and replaces current certificates
+func (s *Store) load() error {
+	byName := map[string]*tls.Certificate{}
+	var first *tls.Certificate
+	for _, c := range s.cfg.Certificates {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return fmt.Errorf("unable to load certificate %s: %w", c.Cert, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate %s: %w", c.Cert, err)
+		}
+		cert.Leaf = leaf
+		if first == nil {
+			first = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// first certificate wins if several of them claim the same name
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+	}
+
+	var clients *x509.CertPool
+	if s.cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(s.cfg.ClientCA)
+		if err != nil {
+			return err
+		}
+		clients = x509.NewCertPool()
+		if !clients.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.cfg.ClientCA)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byName = byName
+	s.first = first
+	s.clients = clients
+	s.stamps = s.fileStamps()
+	return nil
+}
+
+// watch reloads certificates once any of files is modified
+func (s *Store) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.RLock()
+		stamps := s.stamps
+		s.mu.RUnlock()
+		if !changed(stamps, s.fileStamps()) {
+			continue
+		}
+		if err := s.load(); err != nil {
+			s.log.WithError(err).Warnln("TLS certificates are not reloaded, previous ones are used")
+			continue
+		}
+		s.log.Infoln("TLS certificates reloaded")
+	}
+}
+
+func (s *Store) fileStamps() map[string]time.Time {
+	stamps := map[string]time.Time{}
+	files := []string{s.cfg.ClientCA}
+	for _, c := range s.cfg.Certificates {
+		files = append(files, c.Cert, c.Key)
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			stamps[f] = info.ModTime()
+		}
+	}
+	return stamps
+}
+
+func changed(prev, next map[string]time.Time) bool {
+	if len(prev) != len(next) {
+		return true
+	}
+	for f, t := range next {
+		if !prev[f].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
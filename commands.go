@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/ruletest"
+)
+
+// build information, set with -ldflags "-X main.buildVersion=... -X main.buildCommit=... -X main.buildDate=..."
+var (
+	buildVersion = "dev"
+	buildCommit  = "unknown"
+	buildDate    = "unknown"
+)
+
+// validate checks configuration file without starting the proxy, exit code is returned
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+	// file can be passed as an argument as well
+	if fs.NArg() > 0 {
+		*cfgPath = fs.Arg(0)
+	}
+
+	if _, ok := loadConfig(*cfgPath); !ok {
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", *cfgPath)
+	return 0
+}
+
+// routes prints rules in the order they are defined and destination of requests not matching any of them
+func routes(args []string) int {
+	fs := flag.NewFlagSet("routes", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	cfg, ok := loadConfig(*cfgPath)
+	if !ok {
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tPATH\tINTERCEPTORS\tDESTINATION\tUSERS\tSOURCE")
+	for _, rule := range cfg.Rules {
+		interceptors := listOr(stepNames(rule.OnRequest), "-")
+		if rule.DryRun {
+			interceptors += " (dry run)"
+		}
+		fmt.Fprint(w, cfg.Redact(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n",
+			rule.Match.Method,
+			rule.Match.Path,
+			interceptors,
+			destination(cfg, rule),
+			listOr(rule.Users, "*"),
+			rule.Source,
+		)))
+	}
+	fmt.Fprint(w, cfg.Redact(fmt.Sprintf("*\t*\t-\t%s\t*\t-\n", destination(cfg, config.Rule{}))))
+	w.Flush()
+	return 0
+}
+
+// test runs sample requests from the file through the rules without contacting destinations and plugins
+func test(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	verbose := fs.Bool("v", false, "print proxy logs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: verdite test [flags] <cases.yaml>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, ok := loadConfig(*cfgPath)
+	if !ok {
+		return 1
+	}
+	suite, err := ruletest.Load(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log := logger.New()
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	redactLogs(log, cfg.Redact)
+	results, err := ruletest.Run(cfg, suite, log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Printf("PASS  %s\n", r.Case)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s\n", r.Case)
+		for _, f := range r.Failures {
+			fmt.Printf("      %s\n", cfg.Redact(f))
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed\n", len(results)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// version prints build information
+func version() {
+	v := buildVersion
+	// module version is known if binary is installed with "go get"
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	fmt.Printf("verdite %s\n", v)
+	fmt.Printf("  commit: %s\n", buildCommit)
+	fmt.Printf("  built:  %s\n", buildDate)
+	fmt.Printf("  go:     %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// loadConfig reads configuration files printing their problems
+func loadConfig(path string) (*config.Config, bool) {
+	cfg, err := config.New(path)
+	var verr *config.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		for _, p := range verr.Problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return nil, false
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	return cfg, true
+}
+
+// stepNames formats steps of the rule, pipelines are listed by name
+func stepNames(steps []config.Step) []string {
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		names = append(names, step.String())
+	}
+	return names
+}
+
+// destination describes where requests matched by the rule are sent to
+func destination(cfg *config.Config, rule config.Rule) string {
+	if name := rule.Upstream.Name; name != "" {
+		backends := []string{}
+		for _, b := range cfg.Upstreams[name].Backends {
+			backends = append(backends, b.URL)
+		}
+		d := fmt.Sprintf("upstream %s (%s)", name, strings.Join(backends, ", "))
+		if rule.Upstream.StripPrefix != "" {
+			d += fmt.Sprintf(", strip %s", rule.Upstream.StripPrefix)
+		}
+		return d
+	}
+	switch {
+	case rule.Parent == "direct":
+		return "requested host"
+	case rule.Parent != "":
+		return fmt.Sprintf("requested host via %s", rule.Parent)
+	case len(cfg.Parents.Proxies) > 0:
+		return "requested host via parents"
+	}
+	return "requested host"
+}
+
+func listOr(items []string, empty string) string {
+	if len(items) == 0 {
+		return empty
+	}
+	return strings.Join(items, ", ")
+}
@@ -1,78 +1,528 @@
 package config
 
 import (
-	"os"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/go-playground/validator/v10"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Config implements proxy configuration
 type Config struct {
-	Listen       string                 `yaml:"listen" validator:"hostname_port"`
-	Interceptors map[string]Interceptor `yaml:"interceptors"`
-	Rules        []Rule                 `yaml:"rules"`
+	Listen       string                 `yaml:"listen" validate:"omitempty,hostname_port"`
+	TLS          ListenerTLS            `yaml:"tls"`
+	Interceptors map[string]Interceptor `yaml:"interceptors" validate:"dive"`
+	// named chains of interceptors rules can refer to instead of listing them
+	Pipelines map[string][]Step `yaml:"pipelines"`
+	// background calls of async steps
+	Async     Async               `yaml:"async"`
+	Upstreams map[string]Upstream `yaml:"upstreams" validate:"dive"`
+	Admin     Admin               `yaml:"admin"`
+	Shutdown  Shutdown            `yaml:"shutdown"`
+	// circuit breaker applied to every destination host of requests not routed to upstreams
+	CircuitBreaker CircuitBreaker `yaml:"circuitBreaker"`
+	// connection settings used for all destinations, can be overridden by upstreams and rules
+	Transport Transport `yaml:"transport"`
+	// parent proxies outgoing traffic is sent through
+	Parents Parents `yaml:"parents"`
+	// headers describing the proxy and original clients to destinations
+	Headers Headers `yaml:"headers"`
+	// authentication of proxy clients
+	Auth ProxyAuth `yaml:"auth"`
+	// destinations clients are allowed to reach
+	Access Access `yaml:"access"`
+	// SOCKS5 listener sharing destination policies with the HTTP proxy
+	Socks Socks  `yaml:"socks"`
+	Rules []Rule `yaml:"rules" validate:"dive"`
+
+	// values read from files and secret variables, they are hidden in logs and outputs
+	secrets []string
+}
+
+// Headers describes Via, X-Forwarded-* and Forwarded headers of forwarded requests
+type Headers struct {
+	// proxy identifier in Via header, requests already carrying it are rejected as loops; "verdite" by default
+	Via string `yaml:"via"`
+	// X-Forwarded-For/Proto/Host: append (default), replace or off
+	XForwarded string `yaml:"xForwarded" validate:"omitempty,oneof=append replace off"`
+	// RFC 7239 Forwarded: append, replace or off (default)
+	Forwarded string `yaml:"forwarded" validate:"omitempty,oneof=append replace off"`
+}
+
+// ProxyAuth enables Basic authentication of proxy clients (Proxy-Authorization header) if file or interceptor is specified
+type ProxyAuth struct {
+	// htpasswd file with bcrypt hashed passwords, reloaded on change
+	File string `yaml:"file" validate:"omitempty,file"`
+	// interceptor validating credentials instead of the file: IGNORE or FORWARD action accepts client, RESPONSE rejects it
+	Interceptor string `yaml:"interceptor"`
+	// realm reported in Proxy-Authenticate header
+	Realm string `yaml:"realm"`
+	// how often the file is checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// Access describes destination policies of forwarded requests and tunnels, upstream backends are not restricted
+type Access struct {
+	// rules are checked in order, the first matching one is applied
+	Rules []AccessRule `yaml:"rules" validate:"dive"`
+	// private networks (loopback, RFC 1918, link-local, etc ...) are denied unless allowed explicitly or by this flag
+	AllowPrivate bool `yaml:"allowPrivate"`
+	// action applied if no rules match: allow (default) or deny
+	Default string `yaml:"default" validate:"omitempty,oneof=allow deny"`
+}
+
+// AccessRule matches destination if all specified conditions are met
+type AccessRule struct {
+	Name string `yaml:"name"`
+	// allow or deny
+	Action string `yaml:"action" validate:"required,oneof=allow deny"`
+	// hostname patterns: "example.com", "*.example.com" or ".example.com"
+	Hosts []string `yaml:"hosts"`
+	// ports or port ranges: "443", "8000-8999"
+	Ports []string `yaml:"ports"`
+	// networks resolved destination addresses belong to
+	CIDRs []string `yaml:"cidrs"`
+}
+
+// Socks describes SOCKS5 listener, disabled if address is not specified
+type Socks struct {
+	Listen string `yaml:"listen" validate:"omitempty,hostname_port"`
+	// username/password pairs, users of proxy authentication file are accepted if empty,
+	// authentication is not required if neither is specified
+	Users map[string]string `yaml:"users"`
+	// destination ports carrying plaintext HTTP, such sessions are processed by the rules
+	HTTPPorts []int `yaml:"httpPorts"`
+}
+
+// ListenerTLS enables TLS termination on the proxy listener if at least one certificate is specified
+type ListenerTLS struct {
+	Certificates []Certificate `yaml:"certificates" validate:"dive"`
+	// CA bundle used to verify client certificates
+	ClientCA string `yaml:"clientCA"`
+	// none (default), request, verify-if-given or require
+	ClientAuth string `yaml:"clientAuth" validate:"omitempty,oneof=none request verify-if-given require"`
+	// how often files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// Certificate describes PEM-encoded certificate and its private key, certificate is picked by SNI
+type Certificate struct {
+	Cert string `yaml:"cert" validate:"required,file"`
+	Key  string `yaml:"key" validate:"required,file"`
+}
+
+// Parents describes parent proxies and which destinations use them
+type Parents struct {
+	Proxies map[string]ParentProxy `yaml:"proxies" validate:"dive"`
+	// parent used for destinations not matching any domain, direct connections are used if not specified
+	Default string `yaml:"default"`
+	// domain pattern (example.com, *.example.com or .example.com) to parent name, "direct" disables parent
+	Domains map[string]string `yaml:"domains"`
+	// domains, IPs and CIDRs always connected directly
+	NoProxy []string `yaml:"noProxy"`
+}
+
+// ParentProxy describes parent HTTP (CONNECT) or SOCKS5 proxy
+type ParentProxy struct {
+	// http://host:port, https://host:port or socks5://host:port
+	URL      string `yaml:"url" validate:"required,url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 // Interceptor describes request interceptor
 type Interceptor struct {
-	Type     string              `yaml:"type" validator:"oneof=grpc response forward"`
+	Type     string              `yaml:"type" validate:"required,oneof=grpc response forward"`
 	GRPC     InterceptorGRPC     `yaml:"grpc"`
 	Response InterceptorResponse `yaml:"response"`
 	Request  InterceptorRequest  `yaml:"request"`
+	// answers are logged and counted in metrics, but requests proceed as if interceptor returned IGNORE,
+	// anyOf doesn't count such interceptor and tries the next step
+	DryRun bool `yaml:"dryRun"`
 }
 
 // InterceptorGRPC sends request to external GRPC service before processing further
 type InterceptorGRPC struct {
-	Address string `yaml:"address" validator:"required"`
+	Address string `yaml:"address"`
 	// Timeout time.Duration `yaml:"timeout"`
 }
 
 // InterceptorResponse ...
 type InterceptorResponse struct {
-	Status  int               `yaml:"status" validator:"gte=100,lte=600"`
+	Status  int               `yaml:"status" validate:"omitempty,gte=100,lte=599"`
 	Body    string            `yaml:"body"`
 	Headers map[string]string `yaml:"headers"`
 }
 
 // Rule ...
 type Rule struct {
-	Match     Matcher  `yaml:"match"`
-	OnRequest []string `yaml:"onRequest"`
-	ParseBody bool     `yaml:"parseBoy"`
+	// file and line the rule is defined at
+	Source    string        `yaml:"-"`
+	Match     Matcher       `yaml:"match"`
+	OnRequest []Step        `yaml:"onRequest"`
+	ParseBody bool          `yaml:"parseBody"`
+	WebSocket RuleWebSocket `yaml:"websocket"`
+	Upstream  RuleUpstream  `yaml:"upstream"`
+	// overall time to get response from the destination including retries
+	Timeout   time.Duration `yaml:"timeout"`
+	Retry     RuleRetry     `yaml:"retry"`
+	Transport Transport     `yaml:"transport"`
+	// parent proxy name overriding domain based selection, "direct" disables parent
+	Parent string `yaml:"parent"`
+	// authenticated users allowed to use the rule, any client if empty
+	Users []string `yaml:"users"`
+	// answers of the chain steps are logged and counted in metrics, but requests proceed as if they returned IGNORE
+	DryRun bool `yaml:"dryRun"`
+}
+
+// Step describes interceptor, pipeline or combinator called by the rule, can be specified as plain name;
+// exactly one of name, anyOf and allOf is expected
+type Step struct {
+	Name string `yaml:"name"`
+	// interceptor arguments: gRPC plugins get them as params, built-in types use them as overrides
+	// ("status", "body", "method", "url" and "headers.<name>")
+	Args map[string]string `yaml:"args"`
+	// steps are tried in order until one allows the request (IGNORE or FORWARD), the last answer is used otherwise;
+	// steps skipped by their condition don't count, anyOf is skipped if all of them are
+	AnyOf []Step `yaml:"anyOf"`
+	// steps are called in parallel with the same request, all of them have to allow it:
+	// the first denial in order of steps wins, modifications are applied in order of steps
+	// and remaining calls are cancelled once the answer is known
+	AllOf []Step `yaml:"allOf"`
+	// step is skipped unless the request matches
+	When *StepCondition `yaml:"when"`
+	// step called instead if this one fails
+	Fallback *Step `yaml:"fallback"`
+	// interceptor gets a copy of the request in background, its answer is ignored and request is not delayed
+	Async bool `yaml:"async"`
+}
+
+// Async describes queue of requests sent to async steps, requests are dropped if the queue is full
+type Async struct {
+	// max number of requests waiting to be sent, 1000 by default
+	QueueSize int `yaml:"queueSize" validate:"gte=0"`
+	// number of simultaneous calls, 4 by default
+	Workers int `yaml:"workers" validate:"gte=0"`
+	// time given to interceptor to handle the request, 10s by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// StepCondition matches request if all specified conditions are met
+type StepCondition struct {
+	// header name to value regexp, empty value checks that header is present
+	Headers map[string]string `yaml:"headers"`
+	// request path regexp
+	Path string `yaml:"path"`
+}
+
+// UnmarshalYAML accepts both plain name and step object
+func (s *Step) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&s.Name); err == nil {
+		return nil
+	}
+	type plain Step
+	return unmarshal((*plain)(s))
+}
+
+// String formats step as "name", "name(key=value, ...)", "anyOf(...)" or "allOf(...)"
+func (s Step) String() string {
+	switch {
+	case len(s.AnyOf) > 0:
+		return fmt.Sprintf("anyOf(%s)", joinSteps(s.AnyOf))
+	case len(s.AllOf) > 0:
+		return fmt.Sprintf("allOf(%s)", joinSteps(s.AllOf))
+	case len(s.Args) == 0:
+		return s.Name
+	}
+	args := make([]string, 0, len(s.Args))
+	for _, k := range sortedKeys(s.Args) {
+		args = append(args, k+"="+s.Args[k])
+	}
+	return fmt.Sprintf("%s(%s)", s.Name, strings.Join(args, ", "))
+}
+
+func joinSteps(steps []Step) string {
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		names = append(names, step.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// RuleRetry describes how failed requests to the destination are repeated, disabled if attempts are not specified
+type RuleRetry struct {
+	// number of retries after the first try
+	Attempts int `yaml:"attempts" validate:"gte=0"`
+	// connect-error, timeout, 5xx, gateway-error (502, 503, 504) or specific status code
+	On []string `yaml:"on"`
+	// allow retries of POST and PATCH requests, otherwise they are repeated only if connection is not established
+	NonIdempotent bool          `yaml:"nonIdempotent"`
+	PerTryTimeout time.Duration `yaml:"perTryTimeout"`
+	// exponential backoff with full jitter between retries
+	BaseInterval time.Duration `yaml:"baseInterval"`
+	MaxInterval  time.Duration `yaml:"maxInterval"`
+	Budget       RetryBudget   `yaml:"budget"`
+	Hedge        RetryHedge    `yaml:"hedge"`
+	// requests with larger bodies (or unknown length) are sent only once
+	ReplayBodyLimit int64 `yaml:"replayBodyLimit"`
+}
+
+// RetryBudget limits share of retries so failing destination is not overloaded by them
+type RetryBudget struct {
+	// max ratio of retries to requests, 0.2 by default
+	Ratio float64 `yaml:"ratio" validate:"gte=0,lte=1"`
+	// retries per second allowed regardless of the ratio, 3 by default
+	MinPerSecond int `yaml:"minPerSecond" validate:"gte=0"`
+}
+
+// RetryHedge sends additional requests if GET or HEAD request is not answered in time, the first answer wins
+type RetryHedge struct {
+	Delay time.Duration `yaml:"delay"`
+	// max number of simultaneous requests, 2 by default
+	MaxRequests int `yaml:"maxRequests" validate:"gte=0"`
+}
+
+// RuleUpstream routes matched requests to the named upstream (reverse proxy mode)
+// instead of the destination requested by client
+type RuleUpstream struct {
+	Name string `yaml:"name"`
+	// path prefix removed from the request path by whole segments before it is appended to the backend url
+	StripPrefix string `yaml:"stripPrefix"`
+	// keep Host header requested by client instead of the backend one
+	PreserveHost bool `yaml:"preserveHost"`
+}
+
+// Admin describes service listener exposing metrics, disabled if address is not specified
+type Admin struct {
+	Listen string `yaml:"listen" validate:"omitempty,hostname_port"`
+}
+
+// Shutdown describes graceful shutdown on SIGTERM/SIGINT
+type Shutdown struct {
+	// how long active requests and tunnels are waited for before they are interrupted, 30s by default
+	DrainPeriod time.Duration `yaml:"drainPeriod"`
+	// how long the proxy keeps accepting connections after readiness checks start failing,
+	// so that load balancers stop sending new ones before listeners are closed, not delayed by default
+	ReadinessDelay time.Duration `yaml:"readinessDelay"`
+}
+
+// Upstream describes named group of backends
+type Upstream struct {
+	Backends    []Backend           `yaml:"backends" validate:"required,dive"`
+	Balancing   UpstreamBalancing   `yaml:"balancing"`
+	HealthCheck UpstreamHealthCheck `yaml:"healthCheck"`
+	Outlier     UpstreamOutlier     `yaml:"outlierDetection"`
+	// circuit breaker shared by all backends of the upstream
+	CircuitBreaker CircuitBreaker `yaml:"circuitBreaker"`
+	Transport      Transport      `yaml:"transport"`
+}
+
+// Transport describes connections to destinations, unspecified fields are inherited
+// (rule -> upstream -> global settings -> defaults)
+type Transport struct {
+	DialTimeout           time.Duration `yaml:"dialTimeout"`
+	KeepAlive             time.Duration `yaml:"keepAlive"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout"`
+	MaxIdleConns          int           `yaml:"maxIdleConns" validate:"gte=0"`
+	MaxIdleConnsPerHost   int           `yaml:"maxIdleConnsPerHost" validate:"gte=0"`
+	MaxConnsPerHost       int           `yaml:"maxConnsPerHost" validate:"gte=0"`
+	// local address outgoing connections are bound to
+	SourceAddress string `yaml:"sourceAddress" validate:"omitempty,ip"`
+	// static host name to IP address resolution
+	Hosts map[string]string `yaml:"hosts" validate:"dive,ip"`
+	TLS   TransportTLS      `yaml:"tls"`
+}
+
+// TransportTLS describes TLS connections to destinations
+type TransportTLS struct {
+	// PEM bundle of trusted CAs added to the system ones
+	CA string `yaml:"ca" validate:"omitempty,file"`
+	// client certificate presented to destinations
+	Cert               string `yaml:"cert" validate:"required_with=Key,omitempty,file"`
+	Key                string `yaml:"key" validate:"required_with=Cert,omitempty,file"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// CircuitBreaker stops sending requests to the failing destination for a while, disabled if no thresholds are specified
+type CircuitBreaker struct {
+	// open circuit after specified number of consecutive failures (connection errors and 5xx responses)
+	ConsecutiveFailures int `yaml:"consecutiveFailures" validate:"gte=0"`
+	// open circuit if share of failures within the window exceeds specified ratio
+	ErrorRate   float64       `yaml:"errorRate" validate:"gte=0,lte=1"`
+	MinRequests int           `yaml:"minRequests" validate:"gte=0"`
+	Window      time.Duration `yaml:"window"`
+	// time before circuit becomes half-open and lets probe requests through
+	OpenTimeout      time.Duration `yaml:"openTimeout"`
+	HalfOpenRequests int           `yaml:"halfOpenRequests" validate:"gte=0"`
+	// max number of simultaneous requests, exceeding ones are rejected
+	MaxConcurrent int `yaml:"maxConcurrent" validate:"gte=0"`
+	// response returned while circuit is open, 503 by default
+	Response InterceptorResponse `yaml:"response"`
+	// number of destination hosts tracked by the global breaker, least recently used idle ones are dropped,
+	// requests to new hosts are not guarded while all tracked ones are busy, 1000 by default
+	MaxHosts int `yaml:"maxHosts" validate:"gte=0"`
+}
+
+// Enabled checks if any threshold is specified
+func (c CircuitBreaker) Enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.ErrorRate > 0 || c.MaxConcurrent > 0
+}
+
+// Backend describes upstream host, can be specified as plain url string
+type Backend struct {
+	URL    string `yaml:"url" validate:"required,url"`
+	Weight int    `yaml:"weight" validate:"gte=0"`
+}
+
+// UnmarshalYAML accepts both plain url and backend object
+func (b *Backend) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&b.URL); err == nil {
+		return nil
+	}
+	type plain Backend
+	return unmarshal((*plain)(b))
+}
+
+// UpstreamBalancing describes how requests are spread between backends
+type UpstreamBalancing struct {
+	// round-robin (default), least-connections, weighted-random or consistent-hash
+	Policy string `yaml:"policy" validate:"omitempty,oneof=round-robin least-connections weighted-random consistent-hash"`
+	// consistent-hash key, client IP is used if header is not specified
+	HashHeader string `yaml:"hashHeader"`
+}
+
+// UpstreamHealthCheck enables active http checks of backends if path is specified
+type UpstreamHealthCheck struct {
+	Path     string        `yaml:"path" validate:"omitempty,startswith=/"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// consecutive results required to change backend state
+	HealthyThreshold   int `yaml:"healthyThreshold"`
+	UnhealthyThreshold int `yaml:"unhealthyThreshold"`
+}
+
+// UpstreamOutlier ejects backends returning consecutive errors, zero threshold disables the check
+type UpstreamOutlier struct {
+	Consecutive5xx    int           `yaml:"consecutive5xx"`
+	ConsecutiveErrors int           `yaml:"consecutiveErrors"`
+	EjectionTime      time.Duration `yaml:"ejectionTime"`
+}
+
+// RuleWebSocket describes how upgraded (websocket) connections are tunneled once the handshake is allowed
+type RuleWebSocket struct {
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	LogMessages bool          `yaml:"logMessages"`
 }
 
 // Matcher describes http matching rules
 type Matcher struct {
-	Path   string `yaml:"path" validator:"required,uri,startswith=/"`
-	Method string `yaml:"method" validator:"required,oneof=GET POST PUT DELETE PATCH DELETE"`
+	Path   string `yaml:"path" validate:"required,uri,startswith=/"`
+	Method string `yaml:"method" validate:"required,oneof=GET HEAD POST PUT PATCH DELETE OPTIONS"`
 	// TODO: support domains: https://github.com/julienschmidt/httprouter#multi-domain--sub-domains
 }
 
 // InterceptorRequest ...
 type InterceptorRequest struct {
-	Method  string            `yaml:"method" validator:"oneof=GET POST PUT DELETE PATCH DELETE"`
-	URL     string            `yaml:"url" validator:"url"`
+	Method  string            `yaml:"method" validate:"omitempty,oneof=GET HEAD POST PUT PATCH DELETE OPTIONS"`
+	URL     string            `yaml:"url" validate:"omitempty,url"`
 	Headers map[string]string `yaml:"headers"`
 	Body    string            `yaml:"body"`
 }
 
-// New returns configruation instance
+// New returns configruation instance, invalid settings are reported with file names and line numbers;
+// path can point to a single file, directory (all .yaml, .yml and .json files) or glob pattern, files are merged:
+//   - interceptors, pipelines and upstreams are combined, names must be unique
+//   - rules are appended in order of files, each rule keeps its source
+//   - other sections can be defined in a single file only
+//
+// values can refer to environment variables and files: ${VAR}, ${VAR:-default}, ${secret:VAR}, ${file:/path}
 func New(cfgPath string) (*Config, error) {
-	f, err := os.Open(cfgPath)
+	files, err := configFiles(cfgPath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
 	var cfg Config
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		return nil, err
+	docs := newDocuments()
+	problems, conflicts := []Problem{}, []Problem{}
+	for _, file := range files {
+		part, root, fileProblems, err := loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(fileProblems) > 0 {
+			problems = append(problems, fileProblems...)
+			continue
+		}
+		conflicts = append(conflicts, cfg.merge(part, docs, docs.add(file, root))...)
 	}
-	if err := validator.New().Struct(cfg); err != nil {
-		return nil, err
+	// references can't be checked if some file is not decoded
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	// longer secrets are replaced first, so their parts are not left
+	sort.Slice(cfg.secrets, func(i, j int) bool {
+		return len(cfg.secrets[i]) > len(cfg.secrets[j])
+	})
+	problems = append(conflicts, cfg.validate(docs)...)
+	if len(problems) > 0 {
+		sortProblems(problems)
+		return nil, &ValidationError{Problems: problems}
 	}
 	return &cfg, nil
 }
+
+// loadFile decodes single configuration file, document tree is returned to point errors to the lines
+func loadFile(path string) (*Config, *yaml.Node, []Problem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// unknown settings are checked on the source document, the tree can't be decoded strictly
+	problems := []Problem{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&Config{}); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, p := range decodeProblems(path, typeErr) {
+			if strings.HasPrefix(p.Message, "unknown setting") {
+				problems = append(problems, p)
+			}
+		}
+	}
+
+	var cfg Config
+	problems = append(problems, cfg.interpolate(&root, path)...)
+	// values are decoded once references are resolved
+	if len(problems) == 0 && root.Kind != 0 {
+		if err := root.Decode(&cfg); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for _, p := range decodeProblems(path, typeErr) {
+				p.Message = cfg.Redact(p.Message)
+				problems = append(problems, p)
+			}
+		}
+	}
+	return &cfg, &root, problems, nil
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v3"
+)
+
+// extensions of configuration files picked from directory
+var configExtensions = map[string]bool{
+	".yaml": true,
+	".yml":  true,
+	".json": true,
+}
+
+// configFiles lists files of the file, directory or glob pattern in order they are merged;
+// hidden files (editor swap and lock files like .rules.yaml.swp or .#rules.yaml) are skipped.
+// Files are listed on every load, so an upgrade (SIGUSR2) picks up added and removed ones
+func configFiles(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() && !hidden(m) {
+				files = append(files, m)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no configuration files match %s", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !hidden(e.Name()) && configExtensions[filepath.Ext(e.Name())] {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %s", path)
+	}
+	return files, nil
+}
+
+func hidden(file string) bool {
+	return strings.HasPrefix(filepath.Base(file), ".")
+}
+
+// document is a parsed configuration file
+type document struct {
+	file string
+	root *yaml.Node
+}
+
+// documents remembers which file defines each setting, so problems of merged configuration point to its lines
+type documents struct {
+	items []document
+	// top-level section -> document
+	sections map[string]int
+	// "interceptors[name]", "pipelines[name]" and "upstreams[name]" -> document
+	named map[string]int
+	// merged rule -> document and rule position in it
+	rules []rulePosition
+}
+
+type rulePosition struct {
+	doc   int
+	index int
+}
+
+func newDocuments() *documents {
+	return &documents{
+		sections: map[string]int{},
+		named:    map[string]int{},
+	}
+}
+
+// add registers parsed file returning its index
+func (d *documents) add(file string, root *yaml.Node) int {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	d.items = append(d.items, document{file: file, root: root})
+	return len(d.items) - 1
+}
+
+// locate finds file, path in the file and line of the merged configuration setting;
+// the first file is pointed to if setting is not specified in any of them
+func (d *documents) locate(path string) (string, string, int) {
+	if len(d.items) == 0 {
+		return "", path, 0
+	}
+	doc, local := 0, path
+	keys := splitPath(path)
+	switch {
+	case len(keys) == 0:
+	case keys[0] == "rules" && len(keys) > 1:
+		if i, err := strconv.Atoi(keys[1]); err == nil && i >= 0 && i < len(d.rules) {
+			prefix := fmt.Sprintf("rules[%d]", i)
+			doc = d.rules[i].doc
+			local = fmt.Sprintf("rules[%d]", d.rules[i].index) + strings.TrimPrefix(path, prefix)
+		}
+	case (keys[0] == "interceptors" || keys[0] == "pipelines" || keys[0] == "upstreams") && len(keys) > 1:
+		if i, ok := d.named[fmt.Sprintf("%s[%s]", keys[0], keys[1])]; ok {
+			doc = i
+		}
+	default:
+		if i, ok := d.sections[keys[0]]; ok {
+			doc = i
+		}
+	}
+	item := d.items[doc]
+	return item.file, local, lineOf(item.root, local)
+}
+
+// merge adds settings of the file registered in documents, conflicting settings are reported
+func (c *Config) merge(part *Config, docs *documents, doc int) []Problem {
+	item := docs.items[doc]
+	problems := []Problem{}
+	conflict := func(path string, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			File:    item.file,
+			Line:    lineOf(item.root, path),
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	c.secrets = append(c.secrets, part.secrets...)
+
+	// sections specified in the file
+	sections := []string{}
+	if item.root.Kind == yaml.MappingNode {
+		for i := 0; i < len(item.root.Content); i += 2 {
+			sections = append(sections, item.root.Content[i].Value)
+		}
+	}
+
+	for _, section := range sections {
+		switch section {
+		case "interceptors":
+			if c.Interceptors == nil {
+				c.Interceptors = map[string]Interceptor{}
+			}
+			for _, name := range sortedKeys(part.Interceptors) {
+				key := fmt.Sprintf("interceptors[%s]", name)
+				if prev, ok := docs.named[key]; ok {
+					conflict(key, `interceptor "%s" is already defined in %s`, name, docs.items[prev].file)
+					continue
+				}
+				docs.named[key] = doc
+				c.Interceptors[name] = part.Interceptors[name]
+			}
+		case "pipelines":
+			if c.Pipelines == nil {
+				c.Pipelines = map[string][]Step{}
+			}
+			for _, name := range sortedKeys(part.Pipelines) {
+				key := fmt.Sprintf("pipelines[%s]", name)
+				if prev, ok := docs.named[key]; ok {
+					conflict(key, `pipeline "%s" is already defined in %s`, name, docs.items[prev].file)
+					continue
+				}
+				docs.named[key] = doc
+				c.Pipelines[name] = part.Pipelines[name]
+			}
+		case "upstreams":
+			if c.Upstreams == nil {
+				c.Upstreams = map[string]Upstream{}
+			}
+			for _, name := range sortedKeys(part.Upstreams) {
+				key := fmt.Sprintf("upstreams[%s]", name)
+				if prev, ok := docs.named[key]; ok {
+					conflict(key, `upstream "%s" is already defined in %s`, name, docs.items[prev].file)
+					continue
+				}
+				docs.named[key] = doc
+				c.Upstreams[name] = part.Upstreams[name]
+			}
+		case "rules":
+			for i, rule := range part.Rules {
+				path := fmt.Sprintf("rules[%d]", i)
+				rule.Source = fmt.Sprintf("%s:%d", item.file, lineOf(item.root, path))
+				if prev, reason := c.overlap(rule, docs, doc); reason != "" {
+					conflict(path+".match.path", "overlaps with rule %s %s at %s: %s", prev.Match.Method, prev.Match.Path, prev.Source, reason)
+					continue
+				}
+				c.Rules = append(c.Rules, rule)
+				docs.rules = append(docs.rules, rulePosition{doc: doc, index: i})
+			}
+		default:
+			if prev, ok := docs.sections[section]; ok {
+				conflict(section, `"%s" is already defined in %s`, section, docs.items[prev].file)
+				continue
+			}
+			docs.sections[section] = doc
+			copySection(c, part, section)
+		}
+	}
+	return problems
+}
+
+// overlap finds rule of other files which can't be registered along with the rule, conflicts within a file
+// are reported by validation
+func (c *Config) overlap(rule Rule, docs *documents, doc int) (Rule, string) {
+	// invalid method and path are reported by field validation, invalid patterns by route checks
+	if rule.Match.Method == "" || !strings.HasPrefix(rule.Match.Path, "/") || addRoute(&httprouter.Router{}, rule.Match) != "" {
+		return Rule{}, ""
+	}
+	for i, prev := range c.Rules {
+		if docs.rules[i].doc == doc || prev.Match.Method == "" || !strings.HasPrefix(prev.Match.Path, "/") {
+			continue
+		}
+		pair := &httprouter.Router{}
+		if addRoute(pair, prev.Match) != "" {
+			continue
+		}
+		if reason := addRoute(pair, rule.Match); reason != "" {
+			return prev, reason
+		}
+	}
+	return Rule{}, ""
+}
+
+// copySection copies top-level setting by its yaml name
+func copySection(dst, src *Config, name string) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		if strings.SplitN(dv.Type().Field(i).Tag.Get("yaml"), ",", 2)[0] == name {
+			dv.Field(i).Set(sv.Field(i))
+			return
+		}
+	}
+}
+
+// sortedKeys returns names of the map in stable order, so conflicts are reported the same way every time
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
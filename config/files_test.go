@@ -0,0 +1,152 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeRules(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"10-api.yaml": `
+rules:
+  - match:
+      method: GET
+      path: /api/users/:id
+  - match:
+      method: POST
+      path: /api/users
+`,
+		"20-legacy.yaml": `
+rules:
+  - match:
+      method: GET
+      path: /legacy
+  - match:
+      method: GET
+      path: /api/users/*rest
+  - match:
+      method: POST
+      path: /api/users
+`,
+	})
+	defer os.RemoveAll(dir)
+	api, legacy := filepath.Join(dir, "10-api.yaml"), filepath.Join(dir, "20-legacy.yaml")
+
+	_, err := New(dir)
+	problems := problemsOf(t, err)
+	expected := []Problem{
+		{File: legacy, Line: 7, Path: "rules[1].match.path", Message: "overlaps with rule GET /api/users/:id at " + api + ":2: "},
+		{File: legacy, Line: 10, Path: "rules[2].match.path", Message: "overlaps with rule POST /api/users at " + api + ":5: "},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), err)
+	}
+	for i, p := range problems {
+		e := expected[i]
+		if p.File != e.File || p.Line != e.Line || p.Path != e.Path || !strings.HasPrefix(p.Message, e.Message) {
+			t.Errorf("expected %s..., got %s", e, p)
+		}
+	}
+}
+
+func TestMergeSections(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"10-main.yaml": `
+listen: :8080
+interceptors:
+  deny:
+    type: response
+    response:
+      status: 403
+rules:
+  - match:
+      method: GET
+      path: /admin
+    onRequest: [deny]
+`,
+		"20-extra.yaml": `
+listen: :9090
+interceptors:
+  deny:
+    type: response
+    response:
+      status: 401
+rules:
+  - match:
+      method: GET
+      path: /private
+    onRequest: [deny]
+`,
+	})
+	defer os.RemoveAll(dir)
+	main, extra := filepath.Join(dir, "10-main.yaml"), filepath.Join(dir, "20-extra.yaml")
+
+	_, err := New(dir)
+	problems := problemsOf(t, err)
+	expected := []string{
+		extra + `: line 1: listen: "listen" is already defined in ` + main,
+		extra + `: line 3: interceptors[deny]: interceptor "deny" is already defined in ` + main,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), err)
+	}
+	for i, p := range problems {
+		if p.String() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], p.String())
+		}
+	}
+}
+
+func TestConfigFiles(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"10-main.yaml":      "listen: :8080",
+		"20-rules.yml":      "rules: []",
+		"notes.txt":         "not a configuration",
+		".#rules.yaml":      "lock file of the editor",
+		".rules.yaml":       "hidden: true",
+		".20-rules.yml.swp": "swap file of the editor",
+	})
+	defer os.RemoveAll(dir)
+	expected := []string{filepath.Join(dir, "10-main.yaml"), filepath.Join(dir, "20-rules.yml")}
+
+	for _, path := range []string{dir, filepath.Join(dir, "*.y*")} {
+		files, err := configFiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: expected %v, got %v", path, expected, files)
+		}
+	}
+}
+
+func TestReloadFiles(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"10-main.yaml": `
+rules:
+  - match:
+      method: GET
+      path: /admin
+`,
+	})
+	defer os.RemoveAll(dir)
+	if c, err := New(dir); err != nil || len(c.Rules) != 1 {
+		t.Fatalf("expected 1 rule, got %v", err)
+	}
+
+	// upgrade starts the binary with the same arguments, so the directory is listed again
+	if err := ioutil.WriteFile(filepath.Join(dir, "20-extra.yaml"), []byte("rules:\n  - match:\n      method: GET\n      path: /extra\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Rules) != 2 || c.Rules[1].Match.Path != "/extra" {
+		t.Errorf("added file is not loaded: %+v", c.Rules)
+	}
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// replacement of secret values in logs and outputs
+const redacted = "[redacted]"
+
+// shorter secrets are not redacted, otherwise they would rewrite unrelated parts of the output
+const minSecretLength = 4
+
+// reference matches "${VAR}", "${VAR:-default}", "${secret:VAR}", "${file:/path}" and escaped "$${"
+var reference = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// interpolate replaces references to environment variables and files in values of the document,
+// contents of files and "${secret:VAR}" variables are kept as secrets; relative paths are resolved against directory of the document
+func (c *Config) interpolate(node *yaml.Node, file string) []Problem {
+	dir := filepath.Dir(file)
+	problems := []Problem{}
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		switch n.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, child := range n.Content {
+				walk(child)
+			}
+		case yaml.MappingNode:
+			// keys are not interpolated
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		case yaml.ScalarNode:
+			if !strings.Contains(n.Value, "${") {
+				return
+			}
+			value, err := c.expand(n.Value, dir)
+			if err != nil {
+				problems = append(problems, Problem{File: file, Line: n.Line, Message: err.Error()})
+				return
+			}
+			n.Value = value
+			// unquoted value gets its type from the result: "${PORT}" might be a number
+			if n.Style == 0 && n.Tag == "!!str" {
+				n.Tag = ""
+			}
+		}
+	}
+	walk(node)
+	return problems
+}
+
+// expand replaces references in the value
+func (c *Config) expand(value, dir string) (string, error) {
+	var err error
+	expanded := reference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+
+		if strings.HasPrefix(name, "file:") {
+			path := strings.TrimPrefix(name, "file:")
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			data, ferr := ioutil.ReadFile(path)
+			if ferr != nil {
+				err = ferr
+				return ""
+			}
+			// files usually end with a new line which is not a part of the secret
+			secret := strings.TrimRight(string(data), "\r\n")
+			if secret != "" {
+				c.secrets = append(c.secrets, secret)
+			}
+			return secret
+		}
+
+		if strings.HasPrefix(name, "secret:") {
+			name = strings.TrimPrefix(name, "secret:")
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", name)
+				return ""
+			}
+			if v != "" {
+				c.secrets = append(c.secrets, v)
+			}
+			return v
+		}
+
+		fallback, hasFallback := "", false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, fallback, hasFallback = name[:i], name[i+2:], true
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case v == "" && hasFallback:
+			return fallback
+		case !ok:
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// Redact hides secret values in the text
+func (c *Config) Redact(text string) string {
+	for _, secret := range c.secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+		text = strings.Replace(text, secret, redacted, -1)
+	}
+	return text
+}
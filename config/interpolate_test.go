@@ -0,0 +1,65 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	os.Setenv("VERDITE_TEST_HOST", "example.com")
+	os.Setenv("VERDITE_TEST_TOKEN", "s3cr3t-token")
+	os.Setenv("VERDITE_TEST_EMPTY", "")
+	defer os.Unsetenv("VERDITE_TEST_HOST")
+	defer os.Unsetenv("VERDITE_TEST_TOKEN")
+	defer os.Unsetenv("VERDITE_TEST_EMPTY")
+
+	dir, err := ioutil.TempDir("", "verdite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("file-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value    string
+		expanded string
+		secret   bool
+		err      bool
+	}{
+		{"https://${VERDITE_TEST_HOST}/", "https://example.com/", false, false},
+		{"${VERDITE_TEST_EMPTY:-fallback}", "fallback", false, false},
+		{"${VERDITE_TEST_MISSING:-fallback}", "fallback", false, false},
+		{"${VERDITE_TEST_MISSING}", "", false, true},
+		{"Bearer ${secret:VERDITE_TEST_TOKEN}", "Bearer s3cr3t-token", true, false},
+		{"${secret:VERDITE_TEST_MISSING}", "", false, true},
+		{"${file:password}", "file-password", true, false},
+		{"$${VERDITE_TEST_HOST}", "${VERDITE_TEST_HOST}", false, false},
+	}
+	for _, tt := range tests {
+		var c Config
+		expanded, err := c.expand(tt.value, dir)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%s: expected error", tt.value)
+		case !tt.err && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.value, err)
+		case expanded != tt.expanded && !tt.err:
+			t.Errorf("%s: expected %q, got %q", tt.value, tt.expanded, expanded)
+		}
+		if secret := len(c.secrets) > 0; secret != tt.secret {
+			t.Errorf("%s: expected secret %t, got %v", tt.value, tt.secret, c.secrets)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	c := Config{secrets: []string{"s3cr3t-token", "abc", "x"}}
+	text := "token s3cr3t-token for abc at x.example.com"
+	if redacted := c.Redact(text); redacted != "token [redacted] for abc at x.example.com" {
+		t.Errorf("unexpected output: %s", redacted)
+	}
+}
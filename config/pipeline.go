@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// prefix of arguments setting headers of built-in interceptors: "headers.X-Name"
+const headerArg = "headers."
+
+// arguments accepted by built-in interceptor types, gRPC plugins accept any
+var interceptorArgs = map[string]map[string]bool{
+	"response": {"status": true, "body": true},
+	"forward":  {"method": true, "url": true, "body": true},
+}
+
+// Steps returns interceptor calls of the chain, pipelines are replaced by their steps
+func (c *Config) Steps(chain []Step) []Step {
+	return c.expandSteps(chain, map[string]bool{})
+}
+
+func (c *Config) expandSteps(chain []Step, visiting map[string]bool) []Step {
+	steps := []Step{}
+	for _, step := range chain {
+		pipeline, ok := c.Pipelines[step.Name]
+		if !ok {
+			steps = append(steps, step)
+			continue
+		}
+		// cycles are reported by validation
+		if visiting[step.Name] {
+			continue
+		}
+		visiting[step.Name] = true
+		steps = append(steps, c.expandSteps(pipeline, visiting)...)
+		delete(visiting, step.Name)
+	}
+	return steps
+}
+
+// checkPipelines reports steps referring to unknown interceptors, invalid arguments and pipelines including themselves
+func (c *Config) checkPipelines(add report) {
+	for _, name := range sortedKeys(c.Pipelines) {
+		path := fmt.Sprintf("pipelines[%s]", name)
+		if _, ok := c.Interceptors[name]; ok {
+			add(path, `name is used by interceptor as well`)
+		}
+		c.checkSteps(path, c.Pipelines[name], add)
+		if cycle := c.cycle(name, []string{name}); cycle != nil {
+			add(path, "includes itself: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	for i, rule := range c.Rules {
+		c.checkSteps(fmt.Sprintf("rules[%d].onRequest", i), rule.OnRequest, add)
+	}
+}
+
+func (c *Config) checkSteps(path string, steps []Step, add report) {
+	for i, step := range steps {
+		c.checkStep(fmt.Sprintf("%s[%d]", path, i), step, false, add)
+	}
+}
+
+// checkStep validates step, pipelines can't be nested into combinators and fallbacks
+func (c *Config) checkStep(path string, step Step, nested bool, add report) {
+	kinds := 0
+	for _, specified := range []bool{step.Name != "", len(step.AnyOf) > 0, len(step.AllOf) > 0} {
+		if specified {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		add(path, "exactly one of name, anyOf and allOf is required")
+		return
+	}
+	if step.When != nil {
+		checkCondition(path+".when", *step.When, add)
+	}
+	if step.Fallback != nil {
+		c.checkStep(path+".fallback", *step.Fallback, true, add)
+	}
+	if step.Async {
+		switch {
+		case nested:
+			add(path+".async", "is allowed only for steps of the chain")
+		case step.Name == "":
+			add(path+".async", "is allowed only for interceptors")
+		case step.Fallback != nil:
+			add(path+".async", "can't be used with fallback")
+		}
+	}
+
+	switch {
+	case len(step.AnyOf) > 0:
+		for i, s := range step.AnyOf {
+			c.checkStep(fmt.Sprintf("%s.anyOf[%d]", path, i), s, true, add)
+		}
+		return
+	case len(step.AllOf) > 0:
+		for i, s := range step.AllOf {
+			c.checkStep(fmt.Sprintf("%s.allOf[%d]", path, i), s, true, add)
+		}
+		return
+	}
+
+	if _, ok := c.Pipelines[step.Name]; ok {
+		switch {
+		case nested:
+			add(path, `pipeline "%s" can't be used here, only interceptors are allowed`, step.Name)
+		case len(step.Args) > 0 || step.When != nil || step.Fallback != nil || step.Async:
+			add(path, "pipeline doesn't accept arguments, conditions, fallbacks and async flag")
+		}
+		return
+	}
+	interceptor, ok := c.Interceptors[step.Name]
+	if !ok {
+		add(path, `unknown interceptor or pipeline "%s"`, step.Name)
+		return
+	}
+	checkArgs(path+".args", interceptor.Type, step.Args, add)
+}
+
+// checkCondition validates regular expressions of the condition
+func checkCondition(path string, cond StepCondition, add report) {
+	if cond.Path == "" && len(cond.Headers) == 0 {
+		add(path, "path or headers are required")
+	}
+	if _, err := regexp.Compile(cond.Path); err != nil {
+		add(path+".path", "invalid regular expression: %s", err)
+	}
+	for _, name := range sortedKeys(cond.Headers) {
+		if _, err := regexp.Compile(cond.Headers[name]); err != nil {
+			add(fmt.Sprintf("%s.headers[%s]", path, name), "invalid regular expression: %s", err)
+		}
+	}
+}
+
+// checkArgs validates arguments of built-in interceptors
+func checkArgs(path, kind string, args map[string]string, add report) {
+	known, ok := interceptorArgs[kind]
+	if !ok {
+		return
+	}
+	for _, k := range sortedKeys(args) {
+		v := args[k]
+		argPath := fmt.Sprintf("%s[%s]", path, k)
+		switch {
+		case strings.HasPrefix(k, headerArg) && len(k) > len(headerArg):
+		case !known[k]:
+			add(argPath, "is not accepted by %s interceptor", kind)
+		case k == "status":
+			if status, err := strconv.Atoi(v); err != nil || status < 100 || status > 599 {
+				add(argPath, `must be a status code, got "%s"`, v)
+			}
+		case k == "method":
+			if !isMethod(v) {
+				add(argPath, `must be one of: GET HEAD POST PUT PATCH DELETE OPTIONS, got "%s"`, v)
+			}
+		case k == "url":
+			if _, err := url.ParseRequestURI(v); err != nil {
+				add(argPath, `must be a valid URL, got "%s"`, v)
+			}
+		}
+	}
+}
+
+// cycle returns path of pipelines leading back to the first one, nil if there is none
+func (c *Config) cycle(name string, path []string) []string {
+	for _, step := range c.Pipelines[name] {
+		if _, ok := c.Pipelines[step.Name]; !ok {
+			continue
+		}
+		next := append(append([]string{}, path...), step.Name)
+		if step.Name == path[0] {
+			return next
+		}
+		// cycles not involving the first pipeline are reported for their own members
+		if contains(path, step.Name) {
+			continue
+		}
+		if cycle := c.cycle(step.Name, next); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
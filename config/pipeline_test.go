@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// pipelineConfig has a response interceptor "deny", a gRPC one "auth" and the pipelines
+func pipelineConfig(pipelines map[string][]Step) *Config {
+	return &Config{
+		Interceptors: map[string]Interceptor{
+			"deny": {Type: "response"},
+			"auth": {Type: "grpc"},
+		},
+		Pipelines: pipelines,
+	}
+}
+
+// pipelineProblems returns "path: message" of problems found in pipelines and rules
+func pipelineProblems(c *Config) []string {
+	problems := []string{}
+	c.checkPipelines(func(path, format string, args ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	})
+	return problems
+}
+
+func TestCheckSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []Step
+		problems []string
+	}{
+		{
+			name:  "valid steps",
+			steps: []Step{{Name: "auth", Args: map[string]string{"any": "value"}}, {Name: "common"}, {Name: "deny", Args: map[string]string{"status": "401", "headers.X-Reason": "auth"}}},
+		},
+		{
+			name:     "unknown interceptor",
+			steps:    []Step{{Name: "missing"}},
+			problems: []string{`rules[0].onRequest[0]: unknown interceptor or pipeline "missing"`},
+		},
+		{
+			name:     "more than one kind",
+			steps:    []Step{{Name: "auth", AnyOf: []Step{{Name: "deny"}}}, {}},
+			problems: []string{"rules[0].onRequest[0]: exactly one of name, anyOf and allOf is required", "rules[0].onRequest[1]: exactly one of name, anyOf and allOf is required"},
+		},
+		{
+			name:  "invalid arguments of built-in interceptor",
+			steps: []Step{{Name: "deny", Args: map[string]string{"status": "forbidden", "method": "GET"}}},
+			problems: []string{
+				"rules[0].onRequest[0].args[method]: is not accepted by response interceptor",
+				`rules[0].onRequest[0].args[status]: must be a status code, got "forbidden"`,
+			},
+		},
+		{
+			name:     "pipeline nested into combinator",
+			steps:    []Step{{AnyOf: []Step{{Name: "auth"}, {Name: "common"}}}},
+			problems: []string{`rules[0].onRequest[0].anyOf[1]: pipeline "common" can't be used here, only interceptors are allowed`},
+		},
+		{
+			name:     "pipeline used as fallback",
+			steps:    []Step{{Name: "auth", Fallback: &Step{Name: "common"}}},
+			problems: []string{`rules[0].onRequest[0].fallback: pipeline "common" can't be used here, only interceptors are allowed`},
+		},
+		{
+			name:     "pipeline with arguments",
+			steps:    []Step{{Name: "common", Args: map[string]string{"status": "401"}}},
+			problems: []string{"rules[0].onRequest[0]: pipeline doesn't accept arguments, conditions, fallbacks and async flag"},
+		},
+		{
+			name:     "async combinator",
+			steps:    []Step{{AllOf: []Step{{Name: "auth"}}, Async: true}, {Name: "auth", Fallback: &Step{Name: "deny", Async: true}}},
+			problems: []string{"rules[0].onRequest[0].async: is allowed only for interceptors", "rules[0].onRequest[1].fallback.async: is allowed only for steps of the chain"},
+		},
+		{
+			name:     "invalid condition",
+			steps:    []Step{{Name: "auth", When: &StepCondition{Path: "("}}},
+			problems: []string{"rules[0].onRequest[0].when.path: invalid regular expression: error parsing regexp: missing closing ): `(`"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pipelineConfig(map[string][]Step{"common": {{Name: "auth"}}})
+			c.Rules = []Rule{{OnRequest: tt.steps}}
+			problems := pipelineProblems(c)
+			if tt.problems == nil {
+				tt.problems = []string{}
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("expected %q, got %q", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestPipelineCycles(t *testing.T) {
+	tests := []struct {
+		name      string
+		pipelines map[string][]Step
+		problems  []string
+	}{
+		{
+			name: "nested pipelines",
+			pipelines: map[string][]Step{
+				"a": {{Name: "auth"}, {Name: "b"}},
+				"b": {{Name: "c"}, {Name: "deny"}},
+				"c": {{Name: "auth"}},
+			},
+			problems: []string{},
+		},
+		{
+			name: "pipeline includes itself",
+			pipelines: map[string][]Step{
+				"a": {{Name: "auth"}, {Name: "a"}},
+			},
+			problems: []string{"pipelines[a]: includes itself: a -> a"},
+		},
+		{
+			name: "cycle through nested pipelines",
+			pipelines: map[string][]Step{
+				"a": {{Name: "b"}},
+				"b": {{Name: "c"}},
+				"c": {{Name: "deny"}, {Name: "a"}},
+			},
+			problems: []string{
+				"pipelines[a]: includes itself: a -> b -> c -> a",
+				"pipelines[b]: includes itself: b -> c -> a -> b",
+				"pipelines[c]: includes itself: c -> a -> b -> c",
+			},
+		},
+		{
+			name: "pipeline leading to a cycle",
+			pipelines: map[string][]Step{
+				"entry": {{Name: "a"}},
+				"a":     {{Name: "b"}},
+				"b":     {{Name: "a"}},
+			},
+			problems: []string{
+				"pipelines[a]: includes itself: a -> b -> a",
+				"pipelines[b]: includes itself: b -> a -> b",
+			},
+		},
+		{
+			name: "pipeline named as interceptor",
+			pipelines: map[string][]Step{
+				"auth": {{Name: "deny"}},
+			},
+			problems: []string{"pipelines[auth]: name is used by interceptor as well"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if problems := pipelineProblems(pipelineConfig(tt.pipelines)); !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("expected %q, got %q", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestSteps(t *testing.T) {
+	c := pipelineConfig(map[string][]Step{
+		"a":    {{Name: "auth"}, {Name: "b"}},
+		"b":    {{Name: "deny", Args: map[string]string{"status": "401"}}},
+		"loop": {{Name: "auth"}, {Name: "loop"}},
+	})
+	tests := []struct {
+		chain []Step
+		steps []string
+	}{
+		{[]Step{{Name: "deny"}}, []string{"deny"}},
+		{[]Step{{Name: "a"}, {Name: "deny"}}, []string{"auth", "deny(status=401)", "deny"}},
+		{[]Step{{Name: "b"}, {Name: "b"}}, []string{"deny(status=401)", "deny(status=401)"}},
+		{[]Step{{AnyOf: []Step{{Name: "auth"}, {Name: "deny"}}}}, []string{"anyOf(auth, deny)"}},
+		// cycles are reported by validation, expansion stops at them
+		{[]Step{{Name: "loop"}}, []string{"auth"}},
+	}
+	for _, tt := range tests {
+		steps := []string{}
+		for _, step := range c.Steps(tt.chain) {
+			steps = append(steps, step.String())
+		}
+		if !reflect.DeepEqual(steps, tt.steps) {
+			t.Errorf("%s: expected %v, got %v", joinSteps(tt.chain), tt.steps, steps)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v3"
+)
+
+// parent name which disables parent proxy
+const parentDirect = "direct"
+
+// settings section used by each interceptor type
+var interceptorSections = map[string]string{
+	"grpc":     "grpc",
+	"response": "response",
+	"forward":  "request",
+}
+
+// Problem describes invalid setting
+type Problem struct {
+	File string
+	Line int
+	// setting path: rules[0].match.path, interceptors[auth].type, etc ...
+	Path    string
+	Message string
+}
+
+// String formats problem as "file: line N: path: message"
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	if p.File != "" {
+		s = p.File + ": " + s
+	}
+	return s
+}
+
+// ValidationError lists all problems found in configuration files
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// report adds problem of the setting
+type report func(path, format string, args ...interface{})
+
+// validate checks settings and references between them, documents are used to find lines of invalid settings
+func (c *Config) validate(docs *documents) []Problem {
+	problems := []Problem{}
+	add := func(path, format string, args ...interface{}) {
+		file, local, line := docs.locate(path)
+		problems = append(problems, Problem{
+			File:    file,
+			Line:    line,
+			Path:    local,
+			Message: c.Redact(fmt.Sprintf(format, args...)),
+		})
+	}
+
+	v := validator.New()
+	// errors refer to settings by yaml names
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return strings.SplitN(f.Tag.Get("yaml"), ",", 2)[0]
+	})
+	if err := v.Struct(c); err != nil {
+		fieldErrs, ok := err.(validator.ValidationErrors)
+		if !ok {
+			return []Problem{{Message: err.Error()}}
+		}
+		for _, fe := range fieldErrs {
+			add(strings.TrimPrefix(fe.Namespace(), "Config."), "%s", describe(fe))
+		}
+	}
+	c.checkInterceptors(add)
+	c.checkReferences(add)
+	c.checkPipelines(add)
+	c.checkRoutes(add)
+
+	sortProblems(problems)
+	return problems
+}
+
+// checkInterceptors checks settings specific to interceptor types
+func (c *Config) checkInterceptors(add report) {
+	for name, i := range c.Interceptors {
+		own, ok := interceptorSections[i.Type]
+		if !ok {
+			// unknown type is reported by field validation
+			continue
+		}
+		path := fmt.Sprintf("interceptors[%s]", name)
+		specified := map[string]bool{
+			"grpc":     !reflect.ValueOf(i.GRPC).IsZero(),
+			"response": !reflect.ValueOf(i.Response).IsZero(),
+			"request":  !reflect.ValueOf(i.Request).IsZero(),
+		}
+		for section, ok := range specified {
+			if ok && section != own {
+				add(path+"."+section, "is not used by %s interceptor", i.Type)
+			}
+		}
+		switch i.Type {
+		case "grpc":
+			if i.GRPC.Address == "" {
+				add(path+".grpc.address", "is required by grpc interceptor")
+			}
+		case "response":
+			if i.Response.Status == 0 {
+				add(path+".response.status", "is required by response interceptor")
+			}
+		}
+	}
+}
+
+// checkReferences finds interceptors, upstreams and parent proxies which are used but not defined
+func (c *Config) checkReferences(add report) {
+	for i, rule := range c.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if name := rule.Upstream.Name; name != "" {
+			if _, ok := c.Upstreams[name]; !ok {
+				add(path+".upstream.name", `unknown upstream "%s"`, name)
+			}
+		}
+		c.checkParent(path+".parent", rule.Parent, add)
+	}
+	if name := c.Auth.Interceptor; name != "" {
+		i, ok := c.Interceptors[name]
+		switch {
+		case !ok:
+			add("auth.interceptor", `unknown interceptor "%s"`, name)
+		case i.DryRun:
+			add("auth.interceptor", `interceptor "%s" is in dry run mode and can't authenticate clients`, name)
+		}
+	}
+	c.checkParent("parents.default", c.Parents.Default, add)
+	for domain, name := range c.Parents.Domains {
+		c.checkParent(fmt.Sprintf("parents.domains[%s]", domain), name, add)
+	}
+}
+
+func (c *Config) checkParent(path, name string, add report) {
+	if name == "" || name == parentDirect {
+		return
+	}
+	if _, ok := c.Parents.Proxies[name]; !ok {
+		add(path, `unknown parent proxy "%s"`, name)
+	}
+}
+
+// checkRoutes finds rules which can't be registered together, httprouter panics on conflicting paths
+func (c *Config) checkRoutes(add report) {
+	router := &httprouter.Router{}
+	for i, rule := range c.Rules {
+		// invalid method and path are reported by field validation
+		if rule.Match.Method == "" || !strings.HasPrefix(rule.Match.Path, "/") {
+			continue
+		}
+		conflict := addRoute(router, rule.Match)
+		if conflict == "" {
+			continue
+		}
+		path := fmt.Sprintf("rules[%d].match.path", i)
+		if addRoute(&httprouter.Router{}, rule.Match) != "" {
+			add(path, "%s", conflict)
+			continue
+		}
+		// rule causing the conflict is pointed out if there is a single one
+		other := -1
+		for j := 0; j < i && other < 0; j++ {
+			pair := &httprouter.Router{}
+			if addRoute(pair, c.Rules[j].Match) == "" && addRoute(pair, rule.Match) != "" {
+				other = j
+			}
+		}
+		if other < 0 {
+			add(path, "%s", conflict)
+			continue
+		}
+		prev := c.Rules[other]
+		add(path, "conflicts with rule %s %s at %s: %s", prev.Match.Method, prev.Match.Path, prev.Source, conflict)
+	}
+}
+
+// addRoute registers matcher in the router returning conflict description instead of panic
+func addRoute(router *httprouter.Router, m Matcher) (conflict string) {
+	defer func() {
+		if r := recover(); r != nil {
+			conflict = fmt.Sprint(r)
+		}
+	}()
+	router.Handle(m.Method, m.Path, func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+	return ""
+}
+
+// describe explains failed field validation
+func describe(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "required_with":
+		return fmt.Sprintf("is required if %s is specified", strings.ToLower(fe.Param()))
+	}
+	var msg string
+	switch fe.Tag() {
+	case "oneof":
+		msg = "must be one of: " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "gte":
+		msg = "must be greater than or equal to " + fe.Param()
+	case "lte":
+		msg = "must be less than or equal to " + fe.Param()
+	case "hostname_port":
+		msg = "must be host:port"
+	case "url", "uri":
+		msg = "must be a valid " + strings.ToUpper(fe.Tag())
+	case "ip":
+		msg = "must be an IP address"
+	case "file":
+		msg = "file does not exist"
+	case "startswith":
+		msg = fmt.Sprintf(`must start with "%s"`, fe.Param())
+	default:
+		msg = fmt.Sprintf(`failed "%s" check`, fe.Tag())
+	}
+	if value, ok := fe.Value().(string); ok {
+		return fmt.Sprintf("%s, got %q", msg, value)
+	}
+	return fmt.Sprintf("%s, got %v", msg, fe.Value())
+}
+
+// decodeProblems converts decoding errors (unknown settings, wrong types) to problems
+func decodeProblems(file string, err *yaml.TypeError) []Problem {
+	problems := make([]Problem, 0, len(err.Errors))
+	for _, msg := range err.Errors {
+		p := Problem{File: file, Message: msg}
+		if strings.HasPrefix(msg, "line ") {
+			if i := strings.Index(msg, ": "); i > 0 {
+				if line, err := strconv.Atoi(msg[len("line "):i]); err == nil {
+					p.Line = line
+					p.Message = msg[i+2:]
+				}
+			}
+		}
+		// "field foo not found in type config.Rule"
+		if strings.HasPrefix(p.Message, "field ") {
+			if i := strings.Index(p.Message, " not found in type "); i > 0 {
+				p.Message = fmt.Sprintf(`unknown setting "%s"`, p.Message[len("field "):i])
+			}
+		}
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+// lineOf finds line of the setting, line of the closest parent is returned if setting is not specified
+func lineOf(node *yaml.Node, path string) int {
+	line := node.Line
+	for _, key := range splitPath(path) {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// splitPath splits setting path to keys: "rules[0].match" -> "rules", "0", "match"
+func splitPath(path string) []string {
+	keys := []string{}
+	for path != "" {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return append(keys, path[1:])
+			}
+			keys = append(keys, path[1:end])
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			keys = append(keys, path[:end])
+			path = path[end:]
+		}
+	}
+	return keys
+}
+
+// sortProblems orders problems by file and line
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		return problems[i].Line < problems[j].Line
+	})
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigs creates configuration files in temporary directory returning its path
+func writeConfigs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "verdite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.TrimLeft(content, "\n")), 0600); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// problemsOf returns problems of invalid configuration
+func problemsOf(t *testing.T, err error) []Problem {
+	t.Helper()
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	return vErr.Problems
+}
+
+func TestValidateLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name: "unknown settings",
+			config: `
+listen: :8080
+rules:
+  - match:
+      method: GET
+      path: /
+      host: example.com
+    onRequests: []
+`,
+			problems: []string{
+				`line 6: unknown setting "host"`,
+				`line 7: unknown setting "onRequests"`,
+			},
+		},
+		{
+			name: "wrong types",
+			config: `
+interceptors:
+  deny:
+    type: response
+    response:
+      status: forbidden
+`,
+			problems: []string{
+				"line 5: cannot unmarshal !!str `forbidden` into int",
+			},
+		},
+		{
+			name: "invalid values",
+			config: `
+interceptors:
+  deny:
+    type: response
+rules:
+  - match:
+      method: FETCH
+      path: /
+    onRequest: [deny, auth]
+`,
+			problems: []string{
+				"line 2: interceptors[deny].response.status: is required by response interceptor",
+				`line 6: rules[0].match.method: must be one of: GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, got "FETCH"`,
+				`line 8: rules[0].onRequest[1]: unknown interceptor or pipeline "auth"`,
+			},
+		},
+		{
+			name: "conflicting routes",
+			config: `
+rules:
+  - match:
+      method: GET
+      path: /users/:id
+  - match:
+      method: GET
+      path: /users/*any
+`,
+			problems: []string{
+				"line 7: rules[1].match.path: conflicts with rule GET /users/:id at ",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigs(t, map[string]string{"config.yaml": tt.config})
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "config.yaml")
+
+			_, err := New(file)
+			problems := problemsOf(t, err)
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("expected %d problems, got %v", len(tt.problems), err)
+			}
+			for i, p := range problems {
+				if p.File != file {
+					t.Errorf("problem %d: expected file %s, got %s", i, file, p.File)
+				}
+				if s := strings.TrimPrefix(p.String(), file+": "); !strings.HasPrefix(s, tt.problems[i]) {
+					t.Errorf("problem %d: expected %q, got %q", i, tt.problems[i], s)
+				}
+			}
+		})
+	}
+}
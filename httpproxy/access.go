@@ -0,0 +1,251 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+// access actions
+const (
+	accessAllow = "allow"
+	accessDeny  = "deny"
+)
+
+// names of implicit rules reported when destination is denied
+const (
+	accessPrivateRule = "private-networks"
+	accessDefaultRule = "default"
+)
+
+// privateNetworks are denied by default, so clients can't reach internal services through the proxy
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// accessError is returned when destination is denied by access rules
+type accessError struct {
+	addr string
+	rule string
+}
+
+func (e *accessError) Error() string {
+	return fmt.Sprintf(`destination %s is denied by access rule "%s"`, e.addr, e.rule)
+}
+
+func isAccessDenied(err error) bool {
+	var accErr *accessError
+	return errors.As(err, &accErr)
+}
+
+// access checks destinations of forwarded requests and tunnels
+type access struct {
+	rules        []accessRule
+	private      []*net.IPNet
+	allowPrivate bool
+	allowDefault bool
+}
+
+type accessRule struct {
+	name  string
+	allow bool
+	hosts []string
+	ports [][2]int
+	cidrs []*net.IPNet
+}
+
+func newAccess(cfg config.Access) (*access, error) {
+	a := access{
+		allowPrivate: cfg.AllowPrivate,
+		allowDefault: cfg.Default != accessDeny,
+	}
+	a.private, _ = parseCIDRs(privateNetworks)
+
+	for i, rCfg := range cfg.Rules {
+		rule := accessRule{
+			name:  rCfg.Name,
+			allow: rCfg.Action == accessAllow,
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("#%d", i+1)
+		}
+		if rCfg.Action != accessAllow && rCfg.Action != accessDeny {
+			return nil, fmt.Errorf(`access rule "%s": unknown action "%s"`, rule.name, rCfg.Action)
+		}
+		for _, host := range rCfg.Hosts {
+			rule.hosts = append(rule.hosts, strings.ToLower(host))
+		}
+		for _, port := range rCfg.Ports {
+			r, err := parsePortRange(port)
+			if err != nil {
+				return nil, fmt.Errorf(`access rule "%s": %w`, rule.name, err)
+			}
+			rule.ports = append(rule.ports, r)
+		}
+		var err error
+		if rule.cidrs, err = parseCIDRs(rCfg.CIDRs); err != nil {
+			return nil, fmt.Errorf(`access rule "%s": %w`, rule.name, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return &a, nil
+}
+
+// check returns error if destination is denied, ip is nil if address is not resolved yet (parent proxy resolves it)
+func (a *access) check(host string, port int, ip net.IP) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	for _, rule := range a.rules {
+		if rule.match(host, port, ip) {
+			if rule.allow {
+				return nil
+			}
+			return &accessError{addr, rule.name}
+		}
+	}
+	if !a.allowPrivate && ip != nil {
+		for _, cidr := range a.private {
+			if cidr.Contains(ip) {
+				return &accessError{addr, accessPrivateRule}
+			}
+		}
+	}
+	if !a.allowDefault {
+		return &accessError{addr, accessDefaultRule}
+	}
+	return nil
+}
+
+// checkAddr checks destination which is not resolved locally, literal IP addresses are checked as resolved ones
+func (a *access) checkAddr(addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return a.check(host, port, net.ParseIP(host))
+}
+
+// dial resolves destination and connects to the first address allowed by access rules,
+// the checked address is dialed itself, so DNS answer can't change in between (rebinding)
+func (a *access) dial(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, host, target string, port int) (net.Conn, error) {
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		if err := a.check(host, port, ip.IP); err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			continue
+		}
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", target)
+	}
+	return nil, lastErr
+}
+
+func (rule *accessRule) match(host string, port int, ip net.IP) bool {
+	if len(rule.hosts) > 0 {
+		matched := false
+		for _, pattern := range rule.hosts {
+			if matchDomain(pattern, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.ports) > 0 {
+		matched := false
+		for _, r := range rule.ports {
+			if port >= r[0] && port <= r[1] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.cidrs) > 0 {
+		if ip == nil {
+			return false
+		}
+		for _, cidr := range rule.cidrs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parsePortRange parses port ("443") or inclusive port range ("8000-8999")
+func parsePortRange(s string) ([2]int, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid port %s", s)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || min > max || min < 0 || max > 65535 {
+		return [2]int{}, fmt.Errorf("invalid port %s", s)
+	}
+	return [2]int{min, max}, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	res := []*net.IPNet{}
+	for _, s := range list {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cidr)
+	}
+	return res, nil
+}
+
+// splitHostPort splits address returning numeric port
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in address %s", addr)
+	}
+	return host, p, nil
+}
@@ -0,0 +1,99 @@
+package httpproxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+func TestAccessCheck(t *testing.T) {
+	acl, err := newAccess(config.Access{
+		Rules: []config.AccessRule{
+			{Name: "internal-api", Action: accessAllow, Hosts: []string{"api.internal"}, Ports: []string{"8000-8999"}},
+			{Name: "docs", Action: accessDeny, CIDRs: []string{"203.0.113.0/24", "2001:db8::/32"}},
+			{Name: "smtp", Action: accessDeny, Ports: []string{"25"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		rule string
+	}{
+		{"example.com:443", ""},
+		{"EXAMPLE.com.:443", ""},
+		{"example.com:25", "smtp"},
+		{"api.internal:8080", ""},
+		{"api.internal:9000", ""},
+		{"203.0.113.10:443", "docs"},
+		{"203.0.114.10:443", ""},
+		{"[2001:db8::1]:443", "docs"},
+		{"[2001:db9::1]:443", ""},
+		{"127.0.0.1:80", accessPrivateRule},
+		{"10.1.2.3:8080", accessPrivateRule},
+		{"[::1]:80", accessPrivateRule},
+		{"[fe80::1]:80", accessPrivateRule},
+		{"[::ffff:127.0.0.1]:80", accessPrivateRule},
+		{"127.0.0.1:http", "invalid port"},
+		{"[::1]:https", "invalid port"},
+		{"127.0.0.1", "invalid port"},
+	}
+	for _, tt := range tests {
+		err := acl.checkAddr(tt.addr)
+		switch {
+		case tt.rule == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tt.addr, err)
+		case tt.rule == "":
+		case err == nil:
+			t.Errorf("%s: expected to be denied", tt.addr)
+		case tt.rule == "invalid port":
+			if isAccessDenied(err) {
+				t.Errorf("%s: expected invalid address, got %s", tt.addr, err)
+			}
+		default:
+			if accErr, ok := err.(*accessError); !ok || accErr.rule != tt.rule {
+				t.Errorf(`%s: expected to be denied by "%s", got %v`, tt.addr, tt.rule, err)
+			}
+		}
+	}
+}
+
+func TestAccessDefaultDeny(t *testing.T) {
+	acl, err := newAccess(config.Access{
+		Default:      accessDeny,
+		AllowPrivate: true,
+		Rules:        []config.AccessRule{{Action: accessAllow, Hosts: []string{"*.example.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.checkAddr("www.example.com:443"); err != nil {
+		t.Errorf("allowed host is denied: %s", err)
+	}
+	if err := acl.checkAddr("127.0.0.1:80"); err == nil || err.(*accessError).rule != accessDefaultRule {
+		t.Errorf("expected to be denied by default rule, got %v", err)
+	}
+}
+
+func TestDialNamedPort(t *testing.T) {
+	acl, err := newAccess(config.Access{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTransport(config.Transport{}, nil, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address is rejected before dialing, not refused by the destination
+	conn, err := tr.dial(context.Background(), "tcp", "127.0.0.1:http")
+	if err == nil {
+		conn.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "invalid port") {
+		t.Errorf("destination with named port is dialed bypassing access rules: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package httpproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/interceptor"
+	"github.com/afoninsky/verdite/metrics"
+	"github.com/afoninsky/verdite/proto"
+)
+
+// defaults of async queue
+const (
+	defaultAsyncQueueSize = 1000
+	defaultAsyncWorkers   = 4
+	defaultAsyncTimeout   = 10 * time.Second
+)
+
+// asyncQueue sends requests to async interceptors in background by a pool of workers
+type asyncQueue struct {
+	log     *logger.Logger
+	timeout time.Duration
+	jobs    chan asyncJob
+	wg      sync.WaitGroup
+	// jobs are not accepted once queue is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+type asyncJob struct {
+	name    string
+	handler interceptor.Interceptor
+	in      *proto.OnRequestInput
+}
+
+func newAsyncQueue(cfg config.Async, log *logger.Logger) *asyncQueue {
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = defaultAsyncQueueSize
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = defaultAsyncWorkers
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultAsyncTimeout
+	}
+	q := asyncQueue{
+		log:     log,
+		timeout: cfg.Timeout,
+		jobs:    make(chan asyncJob, cfg.QueueSize),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return &q
+}
+
+// push queues the request, it is dropped if the queue is full
+func (q *asyncQueue) push(job asyncJob) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		metrics.AsyncDropped.WithLabelValues(job.name).Inc()
+		return
+	}
+	// counted beforehand, so the gauge doesn't go negative if a worker takes the job right away
+	metrics.AsyncQueued.Inc()
+	select {
+	case q.jobs <- job:
+	default:
+		metrics.AsyncQueued.Dec()
+		metrics.AsyncDropped.WithLabelValues(job.name).Inc()
+		q.log.Debugf(`Async queue is full, request to "%s" interceptor is dropped`, job.name)
+	}
+}
+
+func (q *asyncQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		metrics.AsyncQueued.Dec()
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		_, err := job.handler.OnRequest(ctx, job.in)
+		cancel()
+		if err != nil {
+			metrics.AsyncCalls.WithLabelValues(job.name, "error").Inc()
+			q.log.WithError(err).Warnf(`%s %s: async "%s" interceptor failed`, job.in.Req.Method, job.in.Req.URL, job.name)
+			continue
+		}
+		metrics.AsyncCalls.WithLabelValues(job.name, "ok").Inc()
+	}
+}
+
+// close stops accepting requests and waits until queued ones are sent or context is done
+func (q *asyncQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runAsync queues copy of the request for the interceptor of the step, simulated requests are only traced
+func (s *Proxy) runAsync(st *step, body []byte, r *http.Request) {
+	name := st.cfg.Name
+	if t := requestTrace(r); t != nil {
+		t.step(name, "ASYNC")
+		return
+	}
+	handler, ok := s.handlers[name]
+	if !ok {
+		s.log.Warnf(`%s %s: unable to find "%s" interceptor`, r.Method, r.URL, name)
+		return
+	}
+	s.async.push(asyncJob{
+		name:    name,
+		handler: handler,
+		in:      requestInput(st.cfg.Args, body, r),
+	})
+}
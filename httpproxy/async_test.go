@@ -0,0 +1,102 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/metrics"
+	"github.com/afoninsky/verdite/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// asyncJobOf returns job of the stub interceptor answering with the function
+func asyncJobOf(name string, answer func(ctx context.Context) (*proto.OnRequestOutput, error)) asyncJob {
+	return asyncJob{
+		name:    name,
+		handler: &stubInterceptor{name: name, log: &callLog{}, answer: answer},
+		in:      &proto.OnRequestInput{Req: &proto.HTTPRequest{Method: "GET", URL: "http://example.com/"}},
+	}
+}
+
+func TestAsyncQueueIsFull(t *testing.T) {
+	q := newAsyncQueue(config.Async{QueueSize: 1, Workers: 1}, logger.New())
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	job := asyncJobOf("async-full", func(context.Context) (*proto.OnRequestOutput, error) {
+		started <- struct{}{}
+		<-release
+		return ignore, nil
+	})
+	queued := testutil.ToFloat64(metrics.AsyncQueued)
+
+	// the worker is blocked by the first job, the second one waits in the queue
+	q.push(job)
+	<-started
+	q.push(job)
+	q.push(job)
+	if n := testutil.ToFloat64(metrics.AsyncDropped.WithLabelValues("async-full")); n != 1 {
+		t.Errorf("expected 1 dropped request, got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.AsyncQueued) - queued; n != 1 {
+		t.Errorf("expected 1 queued request, got %v", n)
+	}
+
+	close(release)
+	if err := q.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(metrics.AsyncCalls.WithLabelValues("async-full", "ok")); n != 2 {
+		t.Errorf("expected 2 sent requests, got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.AsyncQueued) - queued; n != 0 {
+		t.Errorf("queued requests are not released: %v", n)
+	}
+}
+
+func TestAsyncQueueIsClosed(t *testing.T) {
+	q := newAsyncQueue(config.Async{}, logger.New())
+	if err := q.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	called := make(chan struct{}, 1)
+	q.push(asyncJobOf("async-closed", func(context.Context) (*proto.OnRequestOutput, error) {
+		called <- struct{}{}
+		return ignore, nil
+	}))
+	if n := testutil.ToFloat64(metrics.AsyncDropped.WithLabelValues("async-closed")); n != 1 {
+		t.Errorf("expected request to be dropped, got %v drops", n)
+	}
+	select {
+	case <-called:
+		t.Error("request is sent after the queue is closed")
+	default:
+	}
+}
+
+func TestAsyncTimeout(t *testing.T) {
+	q := newAsyncQueue(config.Async{Timeout: 10 * time.Millisecond}, logger.New())
+	cancelled := make(chan error, 1)
+	q.push(asyncJobOf("async-timeout", func(ctx context.Context) (*proto.OnRequestOutput, error) {
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+			return ignore, nil
+		}
+	}))
+	if err := <-cancelled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow call is not interrupted by the timeout: %v", err)
+	}
+	if err := q.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(metrics.AsyncCalls.WithLabelValues("async-timeout", "error")); n != 1 {
+		t.Errorf("expected failed call to be counted, got %v", n)
+	}
+}
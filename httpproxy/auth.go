@@ -0,0 +1,265 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultAuthRealm          = "verdite"
+	defaultAuthReloadInterval = 30 * time.Second
+	// successful verifications are cached, so bcrypt isn't run on every request of the client
+	authCacheTTL = time.Minute
+)
+
+type userKey struct{}
+
+// withUser stores authenticated user in the request context
+func withUser(r *http.Request, user string) *http.Request {
+	if user == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// requestUser returns authenticated user, empty if proxy authentication is disabled
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// clientName describes request origin in logs
+func clientName(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return user + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
+
+// passwords keeps bcrypt hashes loaded from htpasswd file
+type passwords struct {
+	file string
+	log  *logger.Logger
+
+	mu     sync.RWMutex
+	hashes map[string][]byte
+	stamp  time.Time
+	// expiration of verified credentials by hash of user and password
+	verified map[[sha256.Size]byte]time.Time
+	// incremented on every reload, so verification of the stale hash isn't cached
+	generation int
+}
+
+func newPasswords(file string, interval time.Duration, log *logger.Logger) (*passwords, error) {
+	p := passwords{
+		file: file,
+		log:  log,
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = defaultAuthReloadInterval
+	}
+	go p.watch(interval)
+	return &p, nil
+}
+
+// load reads "user:hash" lines, only bcrypt hashes are supported
+func (p *passwords) load() error {
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: invalid entry", p.file, line)
+		}
+		user, hash := text[:i], text[i+1:]
+		if !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf(`%s:%d: unsupported hash of user "%s", only bcrypt is supported`, p.file, line, user)
+		}
+		hashes[user] = []byte(hash)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hashes = hashes
+	p.stamp = info.ModTime()
+	p.verified = map[[sha256.Size]byte]time.Time{}
+	p.generation++
+	return nil
+}
+
+// watch reloads passwords once the file is modified
+func (p *passwords) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(p.file)
+		if err != nil {
+			p.log.WithError(err).Warnln("proxy users are not reloaded, previous ones are used")
+			continue
+		}
+		p.mu.RLock()
+		stamp := p.stamp
+		p.mu.RUnlock()
+		if info.ModTime().Equal(stamp) {
+			continue
+		}
+		if err := p.load(); err != nil {
+			p.log.WithError(err).Warnln("proxy users are not reloaded, previous ones are used")
+			continue
+		}
+		p.log.Infoln("proxy users reloaded")
+	}
+}
+
+// verify checks user password, successful checks are cached until the file is reloaded or cache entry expires
+func (p *passwords) verify(user, password string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := time.Now()
+	p.mu.RLock()
+	hash, ok := p.hashes[user]
+	expires, cached := p.verified[key]
+	generation := p.generation
+	p.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if cached && now.Before(expires) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// passwords are reloaded while the hash was checked
+	if generation != p.generation {
+		return true
+	}
+	for k, exp := range p.verified {
+		if now.After(exp) {
+			delete(p.verified, k)
+		}
+	}
+	p.verified[key] = now.Add(authCacheTTL)
+	return true
+}
+
+// proxyAuth authenticates proxy clients using Basic credentials from Proxy-Authorization header
+type proxyAuth struct {
+	cfg       config.ProxyAuth
+	passwords *passwords
+}
+
+func newProxyAuth(cfg config.ProxyAuth, log *logger.Logger) (*proxyAuth, error) {
+	if cfg.File == "" && cfg.Interceptor == "" {
+		return nil, nil
+	}
+	if cfg.File != "" && cfg.Interceptor != "" {
+		return nil, fmt.Errorf("proxy authentication uses either file or interceptor")
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = defaultAuthRealm
+	}
+	a := proxyAuth{
+		cfg: cfg,
+	}
+	if cfg.File != "" {
+		var err error
+		if a.passwords, err = newPasswords(cfg.File, cfg.ReloadInterval, log); err != nil {
+			return nil, err
+		}
+	}
+	return &a, nil
+}
+
+// authenticate passes only authenticated clients to the next handler, credentials are not forwarded further
+func (s *Proxy) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := proxyCredentials(r)
+
+		if s.auth.passwords != nil {
+			if !ok || !s.auth.passwords.verify(user, password) {
+				s.authFailed(w, r, user)
+				return
+			}
+		} else {
+			// interceptor receives claimed user along with Proxy-Authorization header to check it
+			r = withUser(r, user)
+			if !s.callInterceptor(s.auth.cfg.Interceptor, nil, &challengeWriter{ResponseWriter: w, realm: s.auth.cfg.Realm}, r) {
+				s.log.WithField("client", clientName(r)).Warnf("%s %s: proxy authentication is rejected by interceptor", r.Method, r.URL)
+				return
+			}
+		}
+
+		r.Header.Del("Proxy-Authorization")
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// authFailed asks client to provide valid credentials
+func (s *Proxy) authFailed(w http.ResponseWriter, r *http.Request, user string) {
+	s.log.WithField("client", r.RemoteAddr).WithField("user", user).
+		Warnf("%s %s: proxy authentication failed", r.Method, r.URL)
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, s.auth.cfg.Realm))
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+// proxyCredentials parses Basic credentials of Proxy-Authorization header
+func proxyCredentials(r *http.Request) (string, string, bool) {
+	const prefix = "Basic "
+	header := r.Header.Get("Proxy-Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(decoded)
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return credentials[:i], credentials[i+1:], true
+}
+
+// challengeWriter adds authentication challenge to 407 responses of interceptors
+type challengeWriter struct {
+	http.ResponseWriter
+	realm string
+}
+
+func (w *challengeWriter) WriteHeader(status int) {
+	if status == http.StatusProxyAuthRequired && w.Header().Get("Proxy-Authenticate") == "" {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, w.realm))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,76 @@
+package httpproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writePasswords(t *testing.T, file, user, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(user+":"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verdite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	writePasswords(t, file, "alice", "secret")
+
+	p := passwords{file: file}
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if p.verify("alice", "wrong") || p.verify("bob", "secret") {
+		t.Fatal("invalid credentials are accepted")
+	}
+	if len(p.verified) != 0 {
+		t.Errorf("failed verifications are cached: %d entries", len(p.verified))
+	}
+	if !p.verify("alice", "secret") {
+		t.Fatal("valid credentials are rejected")
+	}
+	if len(p.verified) != 1 {
+		t.Fatalf("successful verification is not cached: %d entries", len(p.verified))
+	}
+
+	// cached verification is used without checking the hash
+	p.hashes["alice"] = []byte("$2a$04$invalid")
+	if !p.verify("alice", "secret") {
+		t.Error("cached credentials are rejected")
+	}
+	for k := range p.verified {
+		p.verified[k] = time.Now().Add(-time.Second)
+	}
+	if p.verify("alice", "secret") {
+		t.Error("expired cache entry is used")
+	}
+
+	// password is changed
+	writePasswords(t, file, "alice", "changed")
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.verified) != 0 {
+		t.Error("cache is not cleared on reload")
+	}
+	if p.verify("alice", "secret") {
+		t.Error("old password is accepted after reload")
+	}
+	if !p.verify("alice", "changed") {
+		t.Error("new password is rejected after reload")
+	}
+}
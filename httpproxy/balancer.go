@@ -0,0 +1,108 @@
+package httpproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+// balancer selects one of available backends
+type balancer interface {
+	pick(backends []*backend, r *http.Request) *backend
+}
+
+func newBalancer(cfg config.UpstreamBalancing) (balancer, error) {
+	switch cfg.Policy {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "least-connections":
+		return leastConnections{}, nil
+	case "weighted-random":
+		return weightedRandom{}, nil
+	case "consistent-hash":
+		return consistentHash{header: cfg.HashHeader}, nil
+	default:
+		return nil, fmt.Errorf("unsupported balancing policy: %s", cfg.Policy)
+	}
+}
+
+// roundRobin returns backends one by one
+type roundRobin struct {
+	next uint32
+}
+
+func (s *roundRobin) pick(backends []*backend, r *http.Request) *backend {
+	n := atomic.AddUint32(&s.next, 1)
+	return backends[(n-1)%uint32(len(backends))]
+}
+
+// leastConnections returns backend with the lowest number of in-flight requests (relative to its weight)
+type leastConnections struct{}
+
+func (leastConnections) pick(backends []*backend, r *http.Request) *backend {
+	var best *backend
+	bestLoad := math.MaxFloat64
+	for _, b := range backends {
+		load := float64(atomic.LoadInt64(&b.active)) / float64(b.weight)
+		if load < bestLoad {
+			best, bestLoad = b, load
+		}
+	}
+	return best
+}
+
+// weightedRandom returns random backend with probability proportional to its weight
+type weightedRandom struct{}
+
+func (weightedRandom) pick(backends []*backend, r *http.Request) *backend {
+	total := 0
+	for _, b := range backends {
+		total += b.weight
+	}
+	n := rand.Intn(total)
+	for _, b := range backends {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return backends[len(backends)-1]
+}
+
+// consistentHash sticks requests with the same key (header or client IP) to the same backend,
+// rendezvous hashing is used so only keys of the unavailable backend are moved
+type consistentHash struct {
+	header string
+}
+
+func (s consistentHash) pick(backends []*backend, r *http.Request) *backend {
+	key := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		key = ip
+	}
+	// requests without the header are spread by client IP instead of sticking to a single backend
+	if v := r.Header.Get(s.header); s.header != "" && v != "" {
+		key = v
+	}
+
+	var best *backend
+	bestScore := -1.0
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(b.url.String()))
+		// map hash to (0, 1) and weight it: -w/ln(x) keeps distribution proportional to weights
+		x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(b.weight) / math.Log(x)
+		if score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,48 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestConsistentHash(t *testing.T) {
+	backends := []*backend{}
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://backend-%d.local", i))
+		backends = append(backends, &backend{url: u, weight: 1})
+	}
+	s := consistentHash{header: "X-User"}
+	request := func(ip, user string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = ip + ":12345"
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		return r
+	}
+
+	// the header overrides client IP
+	b := s.pick(backends, request("10.0.0.1", "alice"))
+	for i := 2; i < 20; i++ {
+		if s.pick(backends, request(fmt.Sprintf("10.0.0.%d", i), "alice")) != b {
+			t.Fatal("requests with the same header are sent to different backends")
+		}
+	}
+
+	// requests without the header are spread by client IP, the same IP sticks to its backend
+	picked := map[*backend]bool{}
+	for i := 1; i < 100; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		b := s.pick(backends, request(ip, ""))
+		if s.pick(backends, request(ip, "")) != b {
+			t.Fatalf("requests from %s are sent to different backends", ip)
+		}
+		picked[b] = true
+	}
+	if len(picked) != len(backends) {
+		t.Errorf("requests without the header are sent to %d of %d backends", len(picked), len(backends))
+	}
+}
@@ -0,0 +1,316 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/metrics"
+)
+
+const (
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerOpenTimeout = 30 * time.Second
+	defaultBreakerMinRequests = 20
+	defaultBreakerMaxHosts    = 1000
+)
+
+// circuit breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// BreakerStatus describes circuit breaker state exposed by admin API
+type BreakerStatus struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Requests            int        `json:"requests"`
+	Failures            int        `json:"failures"`
+	Active              int        `json:"active"`
+}
+
+// breakerError is returned when request is rejected by circuit breaker
+type breakerError struct {
+	breaker *breaker
+	reason  string
+}
+
+func (e *breakerError) Error() string {
+	return fmt.Sprintf(`circuit breaker "%s" rejected request: %s`, e.breaker.name, e.reason)
+}
+
+// breaker implements circuit breaker state machine
+type breaker struct {
+	name string
+	cfg  config.CircuitBreaker
+
+	mu            sync.Mutex
+	state         int
+	openedAt      time.Time
+	consecutive   int
+	windowStarted time.Time
+	requests      int
+	failures      int
+	probes        int
+	probesPassed  int
+	active        int
+	// last time the breaker was requested, used to drop unused breakers of destination hosts
+	used time.Time
+}
+
+func newBreaker(name string, cfg config.CircuitBreaker) *breaker {
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = defaultBreakerMinRequests
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if cfg.Response.Status == 0 {
+		cfg.Response.Status = http.StatusServiceUnavailable
+	}
+	if cfg.Response.Body == "" {
+		cfg.Response.Body = "destination is unavailable"
+	}
+	metrics.BreakerState.WithLabelValues(name).Set(breakerClosed)
+	return &breaker{
+		name: name,
+		cfg:  cfg,
+	}
+}
+
+// allow checks if request can be sent, every allowed request should be followed by done()
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cfg.MaxConcurrent > 0 && b.active >= b.cfg.MaxConcurrent {
+		return b.reject("max-concurrent")
+	}
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return b.reject("open")
+		}
+		b.setState(breakerHalfOpen)
+	}
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return b.reject("half-open")
+		}
+		b.probes++
+	}
+	b.active++
+	return nil
+}
+
+// done releases concurrency slot and records request result
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active--
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.setState(breakerOpen)
+			return
+		}
+		b.probesPassed++
+		if b.probesPassed >= b.cfg.HalfOpenRequests {
+			b.setState(breakerClosed)
+		}
+	case breakerClosed:
+		if now := time.Now(); now.Sub(b.windowStarted) > b.cfg.Window {
+			b.windowStarted = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		b.failures++
+		b.consecutive++
+		if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures {
+			b.setState(breakerOpen)
+			return
+		}
+		if b.cfg.ErrorRate > 0 && b.requests >= b.cfg.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.cfg.ErrorRate {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// release frees concurrency slot of request whose result is unknown, it is not counted as success or failure
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active--
+	// probe slot is given to the next request
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *breaker) reject(reason string) error {
+	metrics.BreakerRejected.WithLabelValues(b.name, reason).Inc()
+	return &breakerError{b, reason}
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	b.consecutive = 0
+	b.requests = 0
+	b.failures = 0
+	b.probes = 0
+	b.probesPassed = 0
+	b.windowStarted = time.Now()
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	metrics.BreakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{
+		Name:                b.name,
+		State:               breakerStates[b.state],
+		ConsecutiveFailures: b.consecutive,
+		Requests:            b.requests,
+		Failures:            b.failures,
+		Active:              b.active,
+	}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+	return st
+}
+
+// breakers keeps circuit breakers of destination hosts created on demand
+type breakers struct {
+	cfg   config.CircuitBreaker
+	mu    sync.Mutex
+	items map[string]*breaker
+}
+
+func newBreakers(cfg config.CircuitBreaker) *breakers {
+	if cfg.MaxHosts <= 0 {
+		cfg.MaxHosts = defaultBreakerMaxHosts
+	}
+	return &breakers{
+		cfg:   cfg,
+		items: map[string]*breaker{},
+	}
+}
+
+// get returns breaker of the destination address (host:port), nil if breakers are disabled
+// or all tracked hosts have requests in flight: such request is not guarded rather than growing the map
+func (bs *breakers) get(addr string) *breaker {
+	if !bs.cfg.Enabled() {
+		return nil
+	}
+	addr = strings.ToLower(addr)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.items[addr]
+	if !ok {
+		if len(bs.items) >= bs.cfg.MaxHosts && !bs.evict() {
+			return nil
+		}
+		b = newBreaker(addr, bs.cfg)
+		bs.items[addr] = b
+	}
+	b.mu.Lock()
+	b.used = time.Now()
+	b.mu.Unlock()
+	return b
+}
+
+// evict drops the least recently used breaker without requests in flight, closed ones are dropped first
+// so that open circuits are not reset by requests to many other hosts, false is returned if all breakers are busy
+func (bs *breakers) evict() bool {
+	var victim *breaker
+	var victimUsed time.Time
+	victimClosed := false
+	for _, b := range bs.items {
+		b.mu.Lock()
+		idle, closed, used := b.active == 0, b.state == breakerClosed, b.used
+		b.mu.Unlock()
+		switch {
+		case !idle:
+		case victim == nil, closed && !victimClosed:
+			victim, victimClosed, victimUsed = b, closed, used
+		case closed == victimClosed && used.Before(victimUsed):
+			victim, victimUsed = b, used
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	delete(bs.items, victim.name)
+	metrics.BreakerState.DeleteLabelValues(victim.name)
+	for _, reason := range []string{"max-concurrent", "open", "half-open"} {
+		metrics.BreakerRejected.DeleteLabelValues(victim.name, reason)
+	}
+	return true
+}
+
+// breakerFor returns circuit breaker guarding request destination
+func (s *Proxy) breakerFor(rt *route, r *http.Request) *breaker {
+	if rt.upstream != nil {
+		return rt.upstream.breaker
+	}
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	// tunnels key breakers by host:port as well
+	return s.breakers.get(hostPort(&u))
+}
+
+// CircuitBreakers returns state of all circuit breakers
+func (s *Proxy) CircuitBreakers() []BreakerStatus {
+	list := []BreakerStatus{}
+	for _, u := range s.upstreams {
+		if u.breaker != nil {
+			list = append(list, u.breaker.status())
+		}
+	}
+	s.breakers.mu.Lock()
+	items := make([]*breaker, 0, len(s.breakers.items))
+	for _, b := range s.breakers.items {
+		items = append(items, b)
+	}
+	s.breakers.mu.Unlock()
+	for _, b := range items {
+		list = append(list, b.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
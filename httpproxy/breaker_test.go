@@ -0,0 +1,173 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.CircuitBreaker
+		results []bool
+		state   string
+	}{
+		{"success keeps circuit closed", config.CircuitBreaker{ConsecutiveFailures: 2}, []bool{false, false, false}, "closed"},
+		{"success resets consecutive failures", config.CircuitBreaker{ConsecutiveFailures: 2}, []bool{true, false, true}, "closed"},
+		{"consecutive failures open circuit", config.CircuitBreaker{ConsecutiveFailures: 2}, []bool{false, true, true}, "open"},
+		{"error rate below minimum of requests", config.CircuitBreaker{ErrorRate: 0.5, MinRequests: 4}, []bool{true, true, true}, "closed"},
+		{"error rate opens circuit", config.CircuitBreaker{ErrorRate: 0.5, MinRequests: 4}, []bool{false, true, false, true}, "open"},
+		{"error rate below threshold", config.CircuitBreaker{ErrorRate: 0.5, MinRequests: 4}, []bool{true, false, false, false}, "closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker("test/"+tt.name, tt.cfg)
+			for _, failed := range tt.results {
+				if err := b.allow(); err != nil {
+					t.Fatal(err)
+				}
+				b.done(failed)
+			}
+			if st := b.status(); st.State != tt.state {
+				t.Errorf("expected %s circuit, got %s", tt.state, st.State)
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	cfg := config.CircuitBreaker{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenRequests: 2}
+	open := func() *breaker {
+		b := newBreaker("test/half-open", cfg)
+		b.allow()
+		b.done(true)
+		if err := b.allow(); err == nil {
+			t.Fatal("open circuit allows request")
+		}
+		time.Sleep(cfg.OpenTimeout)
+		return b
+	}
+
+	b := open()
+	for i := 0; i < cfg.HalfOpenRequests; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("probe %d is rejected: %s", i, err)
+		}
+	}
+	if err := b.allow(); err == nil {
+		t.Error("half-open circuit allows more requests than probes")
+	}
+	b.done(false)
+	if st := b.status().State; st != "half-open" {
+		t.Errorf("circuit is %s before all probes passed", st)
+	}
+	b.done(false)
+	if st := b.status().State; st != "closed" {
+		t.Errorf("circuit is %s after probes passed", st)
+	}
+
+	b = open()
+	b.allow()
+	b.done(true)
+	if st := b.status().State; st != "open" {
+		t.Errorf("circuit is %s after failed probe", st)
+	}
+
+	b = open()
+	b.allow()
+	b.release()
+	if err := b.allow(); err != nil {
+		t.Errorf("released probe slot is not reused: %s", err)
+	}
+}
+
+func TestBreakerMaxConcurrent(t *testing.T) {
+	b := newBreaker("test/max-concurrent", config.CircuitBreaker{MaxConcurrent: 1})
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.allow(); err == nil {
+		t.Error("request over the limit is allowed")
+	}
+	b.release()
+	if err := b.allow(); err != nil {
+		t.Errorf("released slot is not reused: %s", err)
+	}
+}
+
+func TestBreakersEviction(t *testing.T) {
+	bs := newBreakers(config.CircuitBreaker{ConsecutiveFailures: 1, MaxHosts: 2})
+
+	failing := bs.get("failing.local:80")
+	failing.allow()
+	failing.done(true)
+	busy := bs.get("busy.local:80")
+	busy.allow()
+
+	// closed idle breakers are dropped before open ones, busy ones are kept
+	for i := 0; i < 3; i++ {
+		bs.get(fmt.Sprintf("host%d.local:80", i))
+	}
+	if bs.items["busy.local:80"] != busy {
+		t.Error("breaker with requests in flight is dropped")
+	}
+	if len(bs.items) != 2 || bs.items["host2.local:80"] == nil {
+		t.Errorf("the most recent breaker is not kept: %v", bs.items)
+	}
+	if bs.items["failing.local:80"] != nil {
+		t.Error("open breaker is kept instead of the most recent one")
+	}
+
+	bs = newBreakers(config.CircuitBreaker{ConsecutiveFailures: 1, MaxHosts: 2})
+	failing = bs.get("failing.local:80")
+	failing.allow()
+	failing.done(true)
+	bs.get("host0.local:80")
+	bs.get("host1.local:80")
+	if bs.items["failing.local:80"] != failing || bs.items["host0.local:80"] != nil {
+		t.Errorf("open breaker is dropped while closed one is kept: %v", bs.items)
+	}
+
+	// requests to a new host are not guarded while all breakers are busy
+	bs = newBreakers(config.CircuitBreaker{ConsecutiveFailures: 1, MaxHosts: 2})
+	for i := 0; i < 2; i++ {
+		bs.get(fmt.Sprintf("busy%d.local:80", i)).allow()
+	}
+	if b := bs.get("new.local:80"); b != nil {
+		t.Errorf("breaker is created while all breakers are busy: %s", b.name)
+	}
+	if len(bs.items) != 2 {
+		t.Errorf("breakers exceed the limit: %v", bs.items)
+	}
+	bs.get("busy0.local:80").done(false)
+	if b := bs.get("new.local:80"); b == nil || len(bs.items) != 2 || bs.items["busy0.local:80"] != nil {
+		t.Errorf("idle breaker is not replaced: %v", bs.items)
+	}
+}
+
+func TestBreakerKey(t *testing.T) {
+	p := newTestProxy(t, &config.Config{
+		CircuitBreaker: config.CircuitBreaker{ConsecutiveFailures: 1},
+	})
+	rt := &route{}
+	tests := []struct {
+		url  string
+		addr string
+	}{
+		{"http://Example.com/", "example.com:80"},
+		{"http://example.com:8080/", "example.com:8080"},
+		{"https://example.com/", "example.com:443"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		// tunnels use the same breaker
+		if b := p.breakerFor(rt, r); b != p.breakers.get(tt.addr) {
+			t.Errorf("%s: expected breaker of %s, got %s", tt.url, tt.addr, b.name)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/proto"
+)
+
+// step is a compiled chain step: interceptor call or combinator of nested steps
+type step struct {
+	cfg      config.Step
+	when     *condition
+	anyOf    []*step
+	allOf    []*step
+	fallback *step
+}
+
+// condition matches request by path and headers
+type condition struct {
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// answer of the interceptor which allows request without modifications
+var ignore = &proto.OnRequestOutput{Action: proto.OnRequestOutput_IGNORE}
+
+// answer of the step which is not called (request doesn't match its condition) or whose answer is not applied
+// (dry run): the chain and allOf proceed as with IGNORE, anyOf tries the next step, compared by pointer
+var skipped = &proto.OnRequestOutput{Action: proto.OnRequestOutput_IGNORE}
+
+func newChain(steps []config.Step) ([]*step, error) {
+	chain := make([]*step, 0, len(steps))
+	for _, cfg := range steps {
+		st, err := newStep(cfg)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, st)
+	}
+	return chain, nil
+}
+
+func newStep(cfg config.Step) (*step, error) {
+	st := step{cfg: cfg}
+	var err error
+	if cfg.When != nil {
+		if st.when, err = newCondition(*cfg.When); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg, err)
+		}
+	}
+	if cfg.Fallback != nil {
+		if st.fallback, err = newStep(*cfg.Fallback); err != nil {
+			return nil, err
+		}
+	}
+	if st.anyOf, err = newChain(cfg.AnyOf); err != nil {
+		return nil, err
+	}
+	if st.allOf, err = newChain(cfg.AllOf); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func newCondition(cfg config.StepCondition) (*condition, error) {
+	c := condition{headers: map[string]*regexp.Regexp{}}
+	var err error
+	if cfg.Path != "" {
+		if c.path, err = regexp.Compile(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	for name, pattern := range cfg.Headers {
+		if c.headers[name], err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// match checks if request satisfies all conditions
+func (c *condition) match(r *http.Request) bool {
+	if c.path != nil && !c.path.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, pattern := range c.headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, v := range values {
+			if pattern.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// run asks step about the request, skipped steps allow it and failed ones are replaced with fallback
+func (s *Proxy) run(ctx context.Context, st *step, body []byte, r *http.Request) (*proto.OnRequestOutput, error) {
+	if st.when != nil && !st.when.match(r) {
+		return skipped, nil
+	}
+	if st.cfg.Async {
+		s.runAsync(st, body, r)
+		return ignore, nil
+	}
+	var data *proto.OnRequestOutput
+	var err error
+	switch {
+	case len(st.anyOf) > 0:
+		data, err = s.runAnyOf(ctx, st.anyOf, body, r)
+	case len(st.allOf) > 0:
+		data, err = s.runAllOf(ctx, st.allOf, body, r)
+	default:
+		data, err = s.call(ctx, st.cfg.Name, st.cfg.Args, body, r)
+		if s.dryRunInterceptors[st.cfg.Name] {
+			s.dryRun(st.cfg.Name, data, err, r)
+			return skipped, nil
+		}
+	}
+	// cancelled step is not needed anymore
+	if err != nil && st.fallback != nil && ctx.Err() == nil {
+		s.log.WithError(err).Warnf("%s %s: %s failed, %s is used instead", r.Method, r.URL, st.cfg, st.fallback.cfg)
+		return s.run(ctx, st.fallback, body, r)
+	}
+	return data, err
+}
+
+// runAnyOf returns the first answer allowing request, or the last answer if none does;
+// skipped steps are not taken into account, anyOf is skipped itself if all of them are
+func (s *Proxy) runAnyOf(ctx context.Context, steps []*step, body []byte, r *http.Request) (*proto.OnRequestOutput, error) {
+	data := skipped
+	var err error
+	for _, st := range steps {
+		answer, answerErr := s.run(ctx, st, body, r)
+		if answerErr == nil && answer == skipped {
+			continue
+		}
+		if answerErr == nil && allows(answer) {
+			return answer, nil
+		}
+		data, err = answer, answerErr
+	}
+	return data, err
+}
+
+// runAllOf calls steps in parallel with the same request: the first failure or denial in order of steps is returned,
+// otherwise request modifications are merged in order of steps; once the answer is known remaining calls are cancelled
+func (s *Proxy) runAllOf(ctx context.Context, steps []*step, body []byte, r *http.Request) (*proto.OnRequestOutput, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	answers := make([]*proto.OnRequestOutput, len(steps))
+	errs := make([]error, len(steps))
+	finished := make([]bool, len(steps))
+	// index of the step deciding the answer, -1 until it is known
+	decision := func() int {
+		for i := range steps {
+			switch {
+			case !finished[i]:
+				return -1
+			case errs[i] != nil || !allows(answers[i]):
+				return i
+			}
+		}
+		return len(steps)
+	}
+
+	if requestTrace(r) != nil {
+		// simulated requests keep order of calls in the trace, steps after the denial are not called
+		for i, st := range steps {
+			answers[i], errs[i] = s.run(ctx, st, body, r)
+			finished[i] = true
+			if decision() >= 0 {
+				break
+			}
+		}
+	} else {
+		type result struct {
+			i    int
+			data *proto.OnRequestOutput
+			err  error
+		}
+		results := make(chan result, len(steps))
+		for i, st := range steps {
+			go func(i int, st *step) {
+				data, err := s.run(ctx, st, body, r)
+				results <- result{i, data, err}
+			}(i, st)
+		}
+		for decision() < 0 {
+			res := <-results
+			answers[res.i], errs[res.i], finished[res.i] = res.data, res.err, true
+		}
+	}
+
+	if i := decision(); i < len(steps) {
+		return answers[i], errs[i]
+	}
+	for _, data := range answers {
+		if data != skipped {
+			return mergeForward(answers), nil
+		}
+	}
+	return skipped, nil
+}
+
+// allows checks if interceptor lets request proceed
+func allows(data *proto.OnRequestOutput) bool {
+	return data.Action == proto.OnRequestOutput_IGNORE || data.Action == proto.OnRequestOutput_FORWARD
+}
+
+// mergeForward combines request modifications, later answers override earlier ones
+func mergeForward(answers []*proto.OnRequestOutput) *proto.OnRequestOutput {
+	var req *proto.HTTPRequest
+	for _, data := range answers {
+		if data.Action != proto.OnRequestOutput_FORWARD || data.Req == nil {
+			continue
+		}
+		if req == nil {
+			req = &proto.HTTPRequest{Headers: map[string]string{}}
+		}
+		if data.Req.Method != "" {
+			req.Method = data.Req.Method
+		}
+		if data.Req.URL != "" {
+			req.URL = data.Req.URL
+		}
+		if len(data.Req.Body) > 0 {
+			req.Body = data.Req.Body
+		}
+		for k, v := range data.Req.Headers {
+			req.Headers[k] = v
+		}
+	}
+	if req == nil {
+		return ignore
+	}
+	return &proto.OnRequestOutput{Action: proto.OnRequestOutput_FORWARD, Req: req}
+}
@@ -0,0 +1,306 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/proto"
+)
+
+// stubInterceptor answers with the function, calls are recorded to the shared log
+type stubInterceptor struct {
+	name   string
+	log    *callLog
+	answer func(ctx context.Context) (*proto.OnRequestOutput, error)
+}
+
+func (i *stubInterceptor) OnRequest(ctx context.Context, _ *proto.OnRequestInput) (*proto.OnRequestOutput, error) {
+	i.log.add(i.name)
+	return i.answer(ctx)
+}
+
+func (i *stubInterceptor) Close() error {
+	return nil
+}
+
+// callLog lists called interceptors in order of calls
+type callLog struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (l *callLog) add(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names = append(l.names, name)
+}
+
+func (l *callLog) calls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.names...)
+}
+
+func answerWith(data *proto.OnRequestOutput, err error) func(context.Context) (*proto.OnRequestOutput, error) {
+	return func(context.Context) (*proto.OnRequestOutput, error) {
+		return data, err
+	}
+}
+
+// delayed answers after the delay unless the call is cancelled
+func delayed(d time.Duration, data *proto.OnRequestOutput) func(context.Context) (*proto.OnRequestOutput, error) {
+	return func(ctx context.Context) (*proto.OnRequestOutput, error) {
+		select {
+		case <-time.After(d):
+			return data, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func denial(status uint32) *proto.OnRequestOutput {
+	return &proto.OnRequestOutput{Action: proto.OnRequestOutput_RESPONSE, Res: &proto.HTTPResponse{Status: status}}
+}
+
+func forwarding(headers map[string]string) *proto.OnRequestOutput {
+	return &proto.OnRequestOutput{Action: proto.OnRequestOutput_FORWARD, Req: &proto.HTTPRequest{Headers: headers}}
+}
+
+// stubProxy creates proxy with stub interceptors sharing the call log
+func stubProxy(t *testing.T, answers map[string]func(context.Context) (*proto.OnRequestOutput, error)) (*Proxy, *callLog) {
+	t.Helper()
+	p := newTestProxy(t, &config.Config{})
+	log := &callLog{}
+	for name, answer := range answers {
+		p.Stub(name, &stubInterceptor{name: name, log: log, answer: answer})
+	}
+	return p, log
+}
+
+// outcome describes answer of the step: "error", "IGNORE", "RESPONSE 403" or "FORWARD X-A=a X-B=b"
+func outcome(data *proto.OnRequestOutput, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case data.Action == proto.OnRequestOutput_RESPONSE:
+		return fmt.Sprintf("RESPONSE %d", data.Res.Status)
+	case data.Action == proto.OnRequestOutput_FORWARD:
+		headers := []string{}
+		for k, v := range data.Req.Headers {
+			headers = append(headers, k+"="+v)
+		}
+		sort.Strings(headers)
+		return strings.TrimSpace("FORWARD " + strings.Join(headers, " "))
+	}
+	return data.Action.String()
+}
+
+func TestRunSteps(t *testing.T) {
+	answers := map[string]func(context.Context) (*proto.OnRequestOutput, error){
+		"allow":     answerWith(ignore, nil),
+		"forward-a": answerWith(forwarding(map[string]string{"X-A": "a"}), nil),
+		"forward-b": answerWith(forwarding(map[string]string{"X-A": "b", "X-B": "b"}), nil),
+		"deny-401":  answerWith(denial(401), nil),
+		"deny-403":  answerWith(denial(403), nil),
+		"slow-403":  delayed(20*time.Millisecond, denial(403)),
+		"fail":      answerWith(nil, errors.New("unavailable")),
+	}
+	steps := func(names ...string) []config.Step {
+		list := []config.Step{}
+		for _, name := range names {
+			list = append(list, config.Step{Name: name})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name    string
+		step    config.Step
+		path    string
+		outcome string
+		// expected order of calls, not checked for parallel calls
+		calls []string
+	}{
+		{
+			name:    "anyOf returns the first allowing answer",
+			step:    config.Step{AnyOf: steps("deny-401", "forward-a", "allow")},
+			outcome: "FORWARD X-A=a",
+			calls:   []string{"deny-401", "forward-a"},
+		},
+		{
+			name:    "anyOf skips failures",
+			step:    config.Step{AnyOf: steps("fail", "allow", "deny-403")},
+			outcome: "IGNORE",
+			calls:   []string{"fail", "allow"},
+		},
+		{
+			name:    "anyOf returns the last answer if none allows",
+			step:    config.Step{AnyOf: steps("deny-401", "deny-403")},
+			outcome: "RESPONSE 403",
+			calls:   []string{"deny-401", "deny-403"},
+		},
+		{
+			name:    "anyOf returns the last failure",
+			step:    config.Step{AnyOf: steps("deny-401", "fail")},
+			outcome: "error",
+			calls:   []string{"deny-401", "fail"},
+		},
+		{
+			name:    "allOf merges modifications in order of steps",
+			step:    config.Step{AllOf: steps("forward-a", "allow", "forward-b")},
+			outcome: "FORWARD X-A=b X-B=b",
+		},
+		{
+			name:    "allOf later modifications override earlier ones",
+			step:    config.Step{AllOf: steps("forward-b", "forward-a")},
+			outcome: "FORWARD X-A=a X-B=b",
+		},
+		{
+			name:    "allOf allows without modifications",
+			step:    config.Step{AllOf: steps("allow", "allow")},
+			outcome: "IGNORE",
+		},
+		{
+			name:    "allOf returns the first denial in order of steps",
+			step:    config.Step{AllOf: steps("forward-a", "slow-403", "deny-401")},
+			outcome: "RESPONSE 403",
+		},
+		{
+			name:    "allOf returns failure",
+			step:    config.Step{AllOf: steps("allow", "fail")},
+			outcome: "error",
+		},
+		{
+			name:    "fallback replaces failed step",
+			step:    config.Step{Name: "fail", Fallback: &config.Step{Name: "deny-401"}},
+			outcome: "RESPONSE 401",
+			calls:   []string{"fail", "deny-401"},
+		},
+		{
+			name:    "fallback is not used on denial",
+			step:    config.Step{Name: "deny-403", Fallback: &config.Step{Name: "allow"}},
+			outcome: "RESPONSE 403",
+			calls:   []string{"deny-403"},
+		},
+		{
+			name:    "fallback replaces failed combinator",
+			step:    config.Step{AnyOf: steps("deny-401", "fail"), Fallback: &config.Step{Name: "forward-a"}},
+			outcome: "FORWARD X-A=a",
+			calls:   []string{"deny-401", "fail", "forward-a"},
+		},
+		{
+			name:    "fallback failure is returned",
+			step:    config.Step{Name: "fail", Fallback: &config.Step{Name: "fail"}},
+			outcome: "error",
+			calls:   []string{"fail", "fail"},
+		},
+		{
+			name:    "step is skipped if request doesn't match",
+			step:    config.Step{Name: "deny-403", When: &config.StepCondition{Path: "^/admin"}},
+			path:    "/public",
+			outcome: "IGNORE",
+			calls:   []string{},
+		},
+		{
+			name:    "skipped step doesn't satisfy anyOf",
+			step:    config.Step{AnyOf: []config.Step{{Name: "allow", When: &config.StepCondition{Path: "^/admin"}}, {Name: "deny-401"}}},
+			path:    "/public",
+			outcome: "RESPONSE 401",
+			calls:   []string{"deny-401"},
+		},
+		{
+			name:    "anyOf is skipped if all steps are skipped",
+			step:    config.Step{AnyOf: []config.Step{{Name: "deny-401", When: &config.StepCondition{Path: "^/admin"}}}},
+			path:    "/public",
+			outcome: "IGNORE",
+			calls:   []string{},
+		},
+		{
+			name: "skipped allOf doesn't satisfy anyOf",
+			step: config.Step{AnyOf: []config.Step{
+				{AllOf: []config.Step{{Name: "allow", When: &config.StepCondition{Path: "^/admin"}}}},
+				{Name: "deny-403"},
+			}},
+			path:    "/public",
+			outcome: "RESPONSE 403",
+			calls:   []string{"deny-403"},
+		},
+		{
+			name:    "step is called if request matches",
+			step:    config.Step{Name: "deny-403", When: &config.StepCondition{Path: "^/admin"}},
+			path:    "/admin/users",
+			outcome: "RESPONSE 403",
+			calls:   []string{"deny-403"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, log := stubProxy(t, answers)
+			st, err := newStep(tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/"
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+
+			if res := outcome(p.run(r.Context(), st, nil, r)); res != tt.outcome {
+				t.Errorf("expected %s, got %s", tt.outcome, res)
+			}
+			if calls := log.calls(); tt.calls != nil && !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("expected calls %v, got %v", tt.calls, calls)
+			}
+		})
+	}
+}
+
+func TestAllOfCancelsRemainingCalls(t *testing.T) {
+	cancelled := make(chan error, 1)
+	p, _ := stubProxy(t, map[string]func(context.Context) (*proto.OnRequestOutput, error){
+		"deny-403": answerWith(denial(403), nil),
+		"slow": func(ctx context.Context) (*proto.OnRequestOutput, error) {
+			select {
+			case <-ctx.Done():
+				cancelled <- ctx.Err()
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				cancelled <- nil
+				return ignore, nil
+			}
+		},
+	})
+	st, err := newStep(config.Step{AllOf: []config.Step{{Name: "deny-403"}, {Name: "slow"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	started := time.Now()
+	if res := outcome(p.run(r.Context(), st, nil, r)); res != "RESPONSE 403" {
+		t.Errorf("expected denial, got %s", res)
+	}
+	if d := time.Since(started); d > time.Second {
+		t.Errorf("answer waits for the slow step: %s", d)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("slow step is not cancelled: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("slow step is not cancelled")
+	}
+}
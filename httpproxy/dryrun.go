@@ -0,0 +1,62 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/afoninsky/verdite/metrics"
+	"github.com/afoninsky/verdite/proto"
+)
+
+// dryRun logs and counts answer which is not applied to the request
+func (s *Proxy) dryRun(name string, data *proto.OnRequestOutput, err error, r *http.Request) {
+	action, status, decision := "error", "", ""
+	switch {
+	case err != nil:
+		decision = "fail: " + err.Error()
+	case data.Action == proto.OnRequestOutput_IGNORE:
+		action, decision = "ignore", "pass the request as is"
+	case data.Action == proto.OnRequestOutput_FORWARD:
+		action, decision = "forward", "modify the request: "+describeChanges(data.Req)
+	case data.Action == proto.OnRequestOutput_RESPONSE && data.Res != nil:
+		action, status = "response", strconv.Itoa(int(data.Res.Status))
+		decision = "answer with " + status
+	default:
+		decision = "return wrong answer " + data.Action.String()
+	}
+	metrics.DryRunDecisions.WithLabelValues(name, action, status).Inc()
+	s.log.WithField("interceptor", name).WithField("client", clientName(r)).
+		Infof("%s %s: dry run, interceptor would %s", r.Method, r.URL, decision)
+}
+
+// describeChanges lists request modifications: method, url, headers and body size
+func describeChanges(req *proto.HTTPRequest) string {
+	if req == nil {
+		return "none"
+	}
+	changes := []string{}
+	if req.Method != "" {
+		changes = append(changes, "method "+req.Method)
+	}
+	if req.URL != "" {
+		changes = append(changes, "url "+req.URL)
+	}
+	if len(req.Headers) > 0 {
+		names := make([]string, 0, len(req.Headers))
+		for name := range req.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		changes = append(changes, "headers "+strings.Join(names, ", "))
+	}
+	if len(req.Body) > 0 {
+		changes = append(changes, fmt.Sprintf("body of %d bytes", len(req.Body)))
+	}
+	if len(changes) == 0 {
+		return "none"
+	}
+	return strings.Join(changes, "; ")
+}
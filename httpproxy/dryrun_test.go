@@ -0,0 +1,70 @@
+package httpproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDryRunIsRecordedOnce(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, &config.Config{
+		Access: config.Access{AllowPrivate: true},
+		Interceptors: map[string]config.Interceptor{
+			"dry-run-deny": {Type: "response", Response: config.InterceptorResponse{Status: 403}, DryRun: true},
+			"dry-run-rule": {Type: "response", Response: config.InterceptorResponse{Status: 401}},
+		},
+		Rules: []config.Rule{{
+			Match:     config.Matcher{Method: http.MethodGet, Path: "/dry"},
+			OnRequest: []config.Step{{Name: "dry-run-deny"}, {Name: "dry-run-rule"}},
+			DryRun:    true,
+		}},
+	})
+
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/dry", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("request is not forwarded in dry run mode: %d %q", w.Code, w.Body.String())
+	}
+	// the interceptor and the rule are both in dry run mode
+	if n := testutil.ToFloat64(metrics.DryRunDecisions.WithLabelValues("dry-run-deny", "response", "403")); n != 1 {
+		t.Errorf("dry run interceptor decision is counted %v times", n)
+	}
+	if n := testutil.ToFloat64(metrics.DryRunDecisions.WithLabelValues("dry-run-deny", "ignore", "")); n != 0 {
+		t.Errorf("ignored answer of dry run interceptor is counted by the rule %v times", n)
+	}
+	if n := testutil.ToFloat64(metrics.DryRunDecisions.WithLabelValues("dry-run-rule", "response", "401")); n != 1 {
+		t.Errorf("dry run rule decision is counted %v times", n)
+	}
+}
+
+func TestDryRunDoesNotSatisfyAnyOf(t *testing.T) {
+	p := newTestProxy(t, &config.Config{
+		Interceptors: map[string]config.Interceptor{
+			"new-auth": {Type: "response", Response: config.InterceptorResponse{Status: 401}, DryRun: true},
+			"old-auth": {Type: "response", Response: config.InterceptorResponse{Status: 403}},
+		},
+		Rules: []config.Rule{{
+			Match:     config.Matcher{Method: http.MethodGet, Path: "/auth"},
+			OnRequest: []config.Step{{AnyOf: []config.Step{{Name: "new-auth"}, {Name: "old-auth"}}}},
+		}},
+	})
+
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/auth", nil))
+	// answer of the dry run interceptor is not applied, so the decision is made by the next one
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected denial of the interceptor which is not in dry run, got %d", w.Code)
+	}
+	if n := testutil.ToFloat64(metrics.DryRunDecisions.WithLabelValues("new-auth", "response", "401")); n != 1 {
+		t.Errorf("dry run interceptor decision is counted %v times", n)
+	}
+}
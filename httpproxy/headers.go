@@ -0,0 +1,213 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+const defaultVia = "verdite"
+
+// modes of X-Forwarded-* and Forwarded headers
+const (
+	headerAppend  = "append"
+	headerReplace = "replace"
+	headerOff     = "off"
+)
+
+// hopHeaders are meaningful only for a single connection, so they are not forwarded (RFC 7230, section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// headers describes the proxy and original clients to destinations
+type headers struct {
+	via        string
+	xForwarded string
+	forwarded  string
+}
+
+func newHeaders(cfg config.Headers) (*headers, error) {
+	h := headers{
+		via:        cfg.Via,
+		xForwarded: cfg.XForwarded,
+		forwarded:  cfg.Forwarded,
+	}
+	if h.via == "" {
+		h.via = defaultVia
+	}
+	if strings.ContainsAny(h.via, " \t,") {
+		return nil, fmt.Errorf(`invalid via identifier "%s"`, h.via)
+	}
+	if h.xForwarded == "" {
+		h.xForwarded = headerAppend
+	}
+	if h.forwarded == "" {
+		h.forwarded = headerOff
+	}
+	for _, mode := range []string{h.xForwarded, h.forwarded} {
+		switch mode {
+		case headerAppend, headerReplace, headerOff:
+		default:
+			return nil, fmt.Errorf(`unknown forwarded headers mode "%s"`, mode)
+		}
+	}
+	return &h, nil
+}
+
+// prepareRequest strips hop-by-hop headers and describes the proxy and original client
+func (h *headers) prepareRequest(r *http.Request) {
+	// protocol upgrade and trailers support are negotiated with the destination again
+	upgrade := ""
+	if isUpgrade(r) {
+		upgrade = r.Header.Get("Upgrade")
+	}
+	trailers := headerHasToken(r.Header, "Te", "trailers")
+	removeHopHeaders(r.Header)
+	if upgrade != "" {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		r.Header.Set("Te", "trailers")
+	}
+
+	h.setXForwarded(r)
+	h.setForwarded(r)
+	addVia(r.Header, r.ProtoMajor, r.ProtoMinor, h.via)
+}
+
+// prepareResponse strips hop-by-hop headers of the destination response
+func (h *headers) prepareResponse(res *http.Response) {
+	removeHopHeaders(res.Header)
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor, h.via)
+}
+
+// isLoop checks if request has already passed through this proxy
+func (h *headers) isLoop(r *http.Request) bool {
+	for _, v := range r.Header["Via"] {
+		for _, entry := range strings.Split(v, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], h.via) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *headers) setXForwarded(r *http.Request) {
+	if h.xForwarded == headerOff {
+		return
+	}
+	if h.xForwarded == headerReplace {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := strings.Join(r.Header["X-Forwarded-For"], ", "); prior != "" {
+			ip = prior + ", " + ip
+		}
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+	// original protocol and host are known to the first proxy in the chain
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+func (h *headers) setForwarded(r *http.Request) {
+	if h.forwarded == headerOff {
+		return
+	}
+	if h.forwarded == headerReplace {
+		r.Header.Del("Forwarded")
+	}
+	element := []string{}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		element = append(element, "for="+forwardedValue(ip))
+	}
+	element = append(element, "proto="+requestScheme(r))
+	if r.Host != "" {
+		element = append(element, "host="+forwardedValue(r.Host))
+	}
+	value := strings.Join(element, ";")
+	if prior := strings.Join(r.Header["Forwarded"], ", "); prior != "" {
+		value = prior + ", " + value
+	}
+	r.Header.Set("Forwarded", value)
+}
+
+// checkLoop rejects requests which have already passed through this proxy
+func (s *Proxy) checkLoop(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.headers.isLoop(r) {
+			s.log.WithField("client", r.RemoteAddr).WithField("via", strings.Join(r.Header["Via"], ", ")).
+				Warnf("%s %s: request loop detected", r.Method, r.URL)
+			http.Error(w, "request loop detected", http.StatusLoopDetected)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// removeHopHeaders removes hop-by-hop headers including ones listed in Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// addVia appends the proxy to the list of intermediaries
+func addVia(h http.Header, major, minor int, via string) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprint(major)
+	}
+	value := version + " " + via
+	if prior := strings.Join(h["Via"], ", "); prior != "" {
+		value = prior + ", " + value
+	}
+	h.Set("Via", value)
+}
+
+// requestScheme returns protocol client used to reach the proxy
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedValue quotes value of Forwarded header parameter if it is not a token
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\"") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+package httpproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/afoninsky/verdite/metrics"
+)
+
+const (
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 2 * time.Second
+	defaultHealthThreshold = 2
+)
+
+// healthCheck periodically requests backends and excludes unhealthy ones from balancing until upstream is closed
+func (u *upstream) healthCheck(transport http.RoundTripper) {
+	cfg := u.cfg.HealthCheck
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	healthyThreshold := cfg.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthThreshold
+	}
+	unhealthyThreshold := cfg.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultHealthThreshold
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// redirect is a valid answer as well
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// consecutive results per backend
+	passed := make([]int, len(u.backends))
+	failed := make([]int, len(u.backends))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-u.done:
+			return
+		}
+		for i, b := range u.backends {
+			if b.probe(client, cfg.Path) {
+				passed[i]++
+				failed[i] = 0
+			} else {
+				failed[i]++
+				passed[i] = 0
+			}
+
+			healthy := atomic.LoadInt32(&b.healthy) == 1
+			switch {
+			case !healthy && passed[i] >= healthyThreshold:
+				atomic.StoreInt32(&b.healthy, 1)
+				metrics.BackendHealthy.WithLabelValues(u.name, b.label).Set(1)
+				u.log.WithField("upstream", u.name).Infof("Backend %s is healthy", b.label)
+			case healthy && failed[i] >= unhealthyThreshold:
+				atomic.StoreInt32(&b.healthy, 0)
+				metrics.BackendHealthy.WithLabelValues(u.name, b.label).Set(0)
+				u.log.WithField("upstream", u.name).Warnf("Backend %s is unhealthy", b.label)
+			}
+		}
+	}
+}
+
+// probe checks if backend responds with successful status
+func (b *backend) probe(client *http.Client, path string) bool {
+	target := *b.url
+	target.Path = joinPath(b.url.Path, path)
+	target.RawQuery = ""
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
@@ -0,0 +1,276 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+	"golang.org/x/net/proxy"
+)
+
+// parentDirect disables parent proxy for a destination
+const parentDirect = "direct"
+
+type parentKey struct{}
+
+// parents selects parent proxy for the destination
+type parents struct {
+	proxies map[string]*url.URL
+	addrs   map[string]bool
+	def     string
+	domains map[string]string
+	noProxy []string
+	noCIDRs []*net.IPNet
+	// proxy identifier sent to parents, so they can detect loops
+	via string
+}
+
+func newParents(cfg config.Parents, via string) (*parents, error) {
+	p := parents{
+		via:     via,
+		proxies: map[string]*url.URL{},
+		addrs:   map[string]bool{},
+		def:     cfg.Default,
+		domains: map[string]string{},
+	}
+	for name, pCfg := range cfg.Proxies {
+		u, err := url.Parse(pCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf(`parent proxy "%s": %w`, name, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf(`parent proxy "%s": unsupported scheme %s`, name, u.Scheme)
+		}
+		if pCfg.Username != "" {
+			u.User = url.UserPassword(pCfg.Username, pCfg.Password)
+		}
+		p.proxies[name] = u
+		p.addrs[hostPort(u)] = true
+	}
+	if err := p.check(cfg.Default); err != nil {
+		return nil, err
+	}
+	for pattern, name := range cfg.Domains {
+		if err := p.check(name); err != nil {
+			return nil, err
+		}
+		p.domains[strings.ToLower(pattern)] = name
+	}
+	for _, entry := range cfg.NoProxy {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			p.noCIDRs = append(p.noCIDRs, cidr)
+			continue
+		}
+		p.noProxy = append(p.noProxy, strings.ToLower(entry))
+	}
+	return &p, nil
+}
+
+// isParent checks if address belongs to one of parent proxies
+func (p *parents) isParent(addr string) bool {
+	return p != nil && p.addrs[addr]
+}
+
+// check makes sure parent is defined
+func (p *parents) check(name string) error {
+	if name == "" || name == parentDirect {
+		return nil
+	}
+	if _, ok := p.proxies[name]; !ok {
+		return fmt.Errorf(`unknown parent proxy "%s"`, name)
+	}
+	return nil
+}
+
+// pick returns parent proxy url for the destination host, nil means direct connection;
+// rule parent has priority over no-proxy list and domain patterns
+func (p *parents) pick(ctx context.Context, host string) *url.URL {
+	if name, ok := ctx.Value(parentKey{}).(string); ok && name != "" {
+		return p.proxies[name]
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if p.bypass(host) {
+		return nil
+	}
+
+	// the most specific (longest) pattern wins
+	name, matched := p.def, ""
+	for pattern, parent := range p.domains {
+		if len(pattern) > len(matched) && matchDomain(pattern, host) {
+			name, matched = parent, pattern
+		}
+	}
+	return p.proxies[name]
+}
+
+// bypass checks if host is listed in no-proxy list
+func (p *parents) bypass(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, cidr := range p.noCIDRs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range p.noProxy {
+		if matchDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain checks host against pattern: "example.com" - exact match,
+// "*.example.com" - subdomains only, ".example.com" - domain and its subdomains
+func matchDomain(pattern, host string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+// withParent forces parent proxy for the request
+func withParent(r *http.Request, name string) *http.Request {
+	if name == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), parentKey{}, name))
+}
+
+// dialVia connects to the destination through the parent proxy if it is required
+func (t *transport) dialVia(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.parents == nil {
+		return t.dial(ctx, network, addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	parent := t.parents.pick(ctx, host)
+	if parent == nil {
+		return t.dial(ctx, network, addr)
+	}
+	// destination is resolved by the parent, so only its name is checked
+	if t.access != nil {
+		if err := t.access.checkAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+	if parent.Scheme == "socks5" {
+		return t.dialSOCKS5(ctx, parent, network, addr)
+	}
+	return t.dialConnect(ctx, parent, addr)
+}
+
+// dialConnect establishes tunnel through HTTP parent proxy
+func (t *transport) dialConnect(ctx context.Context, parent *url.URL, addr string) (net.Conn, error) {
+	conn, err := t.dial(ctx, "tcp", hostPort(parent))
+	if err != nil {
+		return nil, err
+	}
+	if parent.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: parent.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"Via": {"1.1 " + t.parents.via}},
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		auth := parent.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// response body is not closed: successful CONNECT response has no body, the rest of the stream is the tunnel
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("parent proxy %s refused to connect %s: %s", parent.Host, addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 establishes connection through SOCKS5 parent proxy
+func (t *transport) dialSOCKS5(ctx context.Context, parent *url.URL, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		auth = &proxy.Auth{User: parent.User.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", hostPort(parent), auth, dialFunc(t.dial))
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialFunc adapts dial function to proxy.Dialer
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// bufferedConn returns data read ahead from the connection first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// hostPort returns url address with the default port of the scheme if it is not specified
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -3,14 +3,15 @@ package httpproxy
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
 	"github.com/afoninsky/utilities/pkg/logger"
 	"github.com/afoninsky/verdite/config"
@@ -21,66 +22,170 @@ import (
 
 // Proxy ...
 type Proxy struct {
-	log      *logger.Logger
-	handlers map[string]interceptor.Interceptor
-	router   *httprouter.Router
+	log       *logger.Logger
+	handlers  map[string]interceptor.Interceptor
+	upstreams map[string]*upstream
+	router    *httprouter.Router
+	transport *transport
+	direct    *route
+	breakers  *breakers
+	socks     *socksServer
+	auth      *proxyAuth
+	headers   *headers
+	handler   http.Handler
+	// background calls of async steps
+	async *asyncQueue
+	// interceptors whose answers are not applied
+	dryRunInterceptors map[string]bool
+	// hijacked connections which are drained on shutdown
+	conns    *connections
+	draining int32
 }
 
 // New ...
-func New(cfg *config.Config) (*Proxy, error) {
+func New(cfg *config.Config, log *logger.Logger) (*Proxy, error) {
 	s := Proxy{}
-	s.log = logger.New()
+	s.log = log
 	s.router = &httprouter.Router{}
 	s.router.NotFound = http.HandlerFunc(s.defaultRoute)
+	s.breakers = newBreakers(cfg.CircuitBreaker)
+	s.conns = newConnections()
+
+	var err error
+	if s.headers, err = newHeaders(cfg.Headers); err != nil {
+		return nil, err
+	}
+	var parents *parents
+	if len(cfg.Parents.Proxies) > 0 {
+		if parents, err = newParents(cfg.Parents, s.headers.via); err != nil {
+			return nil, err
+		}
+	}
+	acl, err := newAccess(cfg.Access)
+	if err != nil {
+		return nil, err
+	}
+	if s.transport, err = newTransport(cfg.Transport, parents, acl); err != nil {
+		return nil, err
+	}
+	s.direct = &route{transport: s.transport}
+	s.async = newAsyncQueue(cfg.Async, s.log)
+	s.socks = newSocksServer(cfg.Socks, &s)
 
 	// init http request interceptors
 	s.handlers = map[string]interceptor.Interceptor{}
+	s.dryRunInterceptors = map[string]bool{}
 	for name, iCfg := range cfg.Interceptors {
 		rh, err := interceptor.New(name, iCfg)
 		if err != nil {
 			return nil, err
 		}
 		s.handlers[name] = rh
+		if iCfg.DryRun {
+			s.dryRunInterceptors[name] = true
+		}
+	}
+
+	if s.auth, err = newProxyAuth(cfg.Auth, s.log); err != nil {
+		return nil, err
+	}
+	if name := cfg.Auth.Interceptor; name != "" {
+		if _, ok := s.handlers[name]; !ok {
+			return nil, fmt.Errorf(`proxy authentication refers to unknown interceptor "%s"`, name)
+		}
+	}
+
+	// init reverse proxy backends
+	s.upstreams = map[string]*upstream{}
+	for name, uCfg := range cfg.Upstreams {
+		u, err := newUpstream(name, uCfg, s.transport, s.log)
+		if err != nil {
+			return nil, err
+		}
+		s.upstreams[name] = u
 	}
 
 	// create http request matchers
 	for _, rule := range cfg.Rules {
-		handler := s.createRequestHandler(rule)
+		rt, err := s.newRoute(rule)
+		if err != nil {
+			return nil, err
+		}
+		if rt.chain, err = newChain(cfg.Steps(rule.OnRequest)); err != nil {
+			return nil, fmt.Errorf("rule %s %s: %w", rule.Match.Method, rule.Match.Path, err)
+		}
+		handler := s.createRequestHandler(rt)
 		s.router.HandlerFunc(rule.Match.Method, rule.Match.Path, handler)
-		s.log.WithField("interceptors", strings.Join(rule.OnRequest, ",")).
+		names := []string{}
+		for _, st := range rt.chain {
+			names = append(names, st.cfg.String())
+		}
+		s.log.WithField("interceptors", strings.Join(names, ",")).
+			WithField("source", rule.Source).
 			Infof("Rule added: %s //*%s", rule.Match.Method, rule.Match.Path)
 	}
 
 	// s.router.Use(s.loggingMiddleware)
 
+	s.handler = s.checkLoop(s.router)
+	if s.auth != nil {
+		s.handler = s.authenticate(s.handler)
+	}
 	return &s, nil
 }
 
 // Handler returns http default middleware
-func (s *Proxy) Handler() *httprouter.Router {
-	return s.router
+func (s *Proxy) Handler() http.Handler {
+	return s.handler
 }
 
 // implements default logic if no routes found
 func (s *Proxy) defaultRoute(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
-		tunnelForwarder(w, r)
+	s.forward(w, r, s.direct)
+}
+
+// forward passes request to its destination
+func (s *Proxy) forward(w http.ResponseWriter, r *http.Request, rt *route) {
+	r = withParent(r, rt.rule.Parent)
+	if r.Method != http.MethodConnect {
+		s.headers.prepareRequest(r)
+	}
+	// simulated requests are not sent anywhere
+	if t := requestTrace(r); t != nil {
+		t.forward(rt.route(r), rt)
 		return
 	}
-	httpForwarder(w, r)
+	switch {
+	case r.Method == http.MethodConnect:
+		s.tunnelForwarder(w, r, rt)
+	case isUpgrade(r):
+		s.upgradeForwarder(w, rt.route(r), rt)
+	default:
+		s.httpForwarder(w, r, rt)
+	}
 }
 
-func (s *Proxy) createRequestHandler(cfg config.Rule) func(w http.ResponseWriter, r *http.Request) {
+func (s *Proxy) createRequestHandler(rt *route) func(w http.ResponseWriter, r *http.Request) {
+	cfg := rt.rule
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		chain := []string{}
+		if t := requestTrace(r); t != nil {
+			t.Rule = cfg.Match.Method + " " + cfg.Match.Path
+		}
 
 		defer func() {
 			s.log.WithField("rules", strings.Join(chain, ",")).
+				WithField("client", clientName(r)).
 				Infof("%s %s", r.Method, r.URL)
 		}()
 
+		if len(cfg.Users) > 0 && !hasUser(cfg.Users, requestUser(r)) {
+			http.Error(w, "access to the resource is denied", http.StatusForbidden)
+			return
+		}
+
 		// parse body if according flag is specified
 		// by default body is not parsed and passed "as is" to avoid request processing time increase
 		var body []byte
@@ -91,38 +196,63 @@ func (s *Proxy) createRequestHandler(cfg config.Rule) func(w http.ResponseWriter
 				http.Error(w, err.Error(), http.StatusServiceUnavailable)
 				return
 			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
 		}
 
 		// apply chain of request interceptora
-		for _, name := range cfg.OnRequest {
-			chain = append(chain, name)
-			if !s.callInterceptor(name, body, w, r) {
-				break
+		for _, st := range rt.chain {
+			chain = append(chain, st.cfg.String())
+			data, err := s.run(r.Context(), st, body, r)
+			// async steps don't have answers, answers of dry run interceptors are already recorded
+			if cfg.DryRun && !st.cfg.Async {
+				if !s.dryRunInterceptors[st.cfg.Name] {
+					s.dryRun(st.cfg.String(), data, err, r)
+				}
+				continue
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if !s.apply(data, w, r) {
+				return
 			}
 		}
+
+		// upgrade handshake is allowed as well, so connection is tunneled afterwards
+		s.forward(w, r, rt)
 	}
 }
 
 func (s *Proxy) callInterceptor(name string, body []byte, w http.ResponseWriter, r *http.Request) bool {
+	data, err := s.call(r.Context(), name, nil, body, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	return s.apply(data, w, r)
+}
+
+// call asks interceptor about the request, the request is not modified
+func (s *Proxy) call(ctx context.Context, name string, params map[string]string, body []byte, r *http.Request) (*proto.OnRequestOutput, error) {
 	handler, ok := s.handlers[name]
 	if !ok {
-		http.Error(w, fmt.Sprintf(`unable to find "%s" interceptor`, name), http.StatusServiceUnavailable)
-		return false
+		return nil, fmt.Errorf(`unable to find "%s" interceptor`, name)
 	}
 
-	data, err := handler.OnRequest(context.Background(), &proto.OnRequestInput{
-		Req: &proto.HTTPRequest{
-			Method:  r.Method,
-			URL:     r.RequestURI,
-			Headers: mapHeaders(r.Header),
-			Body:    body,
-		},
-	})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return false
+	data, err := handler.OnRequest(ctx, requestInput(params, body, r))
+	if t := requestTrace(r); t != nil {
+		if err != nil {
+			t.step(name, err)
+		} else {
+			t.step(name, data.Action)
+		}
 	}
+	return data, err
+}
 
+// apply updates the request or writes the response according to interceptor answer, false means request is answered
+func (s *Proxy) apply(data *proto.OnRequestOutput, w http.ResponseWriter, r *http.Request) bool {
 	switch data.Action {
 	// do not modify request and pass it further
 	case proto.OnRequestOutput_IGNORE:
@@ -163,6 +293,46 @@ func (s *Proxy) callInterceptor(name string, body []byte, w http.ResponseWriter,
 	}
 }
 
+// requestInput describes request to interceptors
+func requestInput(params map[string]string, body []byte, r *http.Request) *proto.OnRequestInput {
+	return &proto.OnRequestInput{
+		Req: &proto.HTTPRequest{
+			Method:  r.Method,
+			URL:     r.RequestURI,
+			Headers: mapHeaders(r.Header),
+			Body:    body,
+		},
+		Client: clientInfo(r),
+		Params: params,
+	}
+}
+
+// clientInfo describes request origin, certificate is specified only if it is verified
+func clientInfo(r *http.Request) *proto.ClientInfo {
+	info := proto.ClientInfo{
+		Address: r.RemoteAddr,
+		User:    requestUser(r),
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		fingerprint := sha256.Sum256(cert.Raw)
+		info.CertSubject = cert.Subject.String()
+		info.CertDNSNames = cert.DNSNames
+		info.CertFingerprint = hex.EncodeToString(fingerprint[:])
+	}
+	return &info
+}
+
+// hasUser checks if user is listed
+func hasUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
 // convert http.Header slice to a map containing headers
 func mapHeaders(src http.Header) map[string]string {
 	dst := map[string]string{}
@@ -182,43 +352,119 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
-func httpForwarder(w http.ResponseWriter, r *http.Request) {
-	res, err := http.DefaultTransport.RoundTrip(r)
+func (s *Proxy) httpForwarder(w http.ResponseWriter, r *http.Request, rt *route) {
+	res, err := s.send(r, rt)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		s.upstreamError(w, r, err)
 		return
 	}
 	defer res.Body.Close()
+	s.headers.prepareResponse(res)
 	copyHeaders(w.Header(), res.Header)
 	w.WriteHeader(res.StatusCode)
-	if _, err := io.Copy(w, res.Body); err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	if err := copyResponse(w, res.Body); err != nil {
+		s.log.WithError(err).Warnf("%s %s: response is interrupted", r.Method, r.URL)
+		return
+	}
+	// trailers are known only after the body is read (gRPC status, etc ...)
+	for k, vv := range res.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// upstreamError responds with gateway error, details are logged instead of being exposed to the client
+func (s *Proxy) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	var accErr *accessError
+	if errors.As(err, &accErr) {
+		s.log.WithField("access", accErr.rule).Warnf("%s %s: destination %s is denied", r.Method, r.URL, accErr.addr)
+		http.Error(w, fmt.Sprintf("access to %s is denied", accErr.addr), http.StatusForbidden)
+		return
+	}
+	s.log.WithError(err).Warnf("%s %s: destination request failed", r.Method, r.URL)
+	var brErr *breakerError
+	if errors.As(err, &brErr) {
+		res := brErr.breaker.cfg.Response
+		for k, v := range res.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(res.Status)
+		io.WriteString(w, res.Body)
 		return
 	}
+	if isTimeout(err) {
+		http.Error(w, "destination request timeout", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "destination request failed", http.StatusBadGateway)
 }
 
-func tunnelForwarder(w http.ResponseWriter, r *http.Request) {
-	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+// copyResponse copies response body flushing every chunk, so streamed responses are not delayed
+func copyResponse(w http.ResponseWriter, src io.Reader) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(w, src)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Proxy) tunnelForwarder(w http.ResponseWriter, r *http.Request, rt *route) {
+	destConn, err := s.dialTunnel(r.Context(), rt, r.Host)
 	if err != nil {
+		s.tunnelFailed(tunnelHTTP, clientName(r), r.Host, err)
+		var brErr *breakerError
+		var accErr *accessError
+		if errors.As(err, &accErr) {
+			http.Error(w, fmt.Sprintf("access to %s is denied", accErr.addr), http.StatusForbidden)
+			return
+		}
+		if errors.As(err, &brErr) {
+			s.upstreamError(w, r, err)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	// HTTP/2 streams can't be hijacked: tunnel is established over request and response bodies
+	if r.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		s.tunnel(tunnelHTTP, clientName(r), r.Host, &streamConn{ReadCloser: r.Body, w: w}, destConn)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
+		destConn.Close()
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 		return
 	}
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, buf, err := hijacker.Hijack()
 	if err != nil {
+		destConn.Close()
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	go transfer(destConn, clientConn)
-	go transfer(clientConn, destConn)
-}
-
-func transfer(destination io.WriteCloser, source io.ReadCloser) {
-	defer destination.Close()
-	defer source.Close()
-	io.Copy(destination, source)
+	// client may start sending data before reading the response
+	if buf.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: clientConn, r: buf.Reader}
+	}
+	s.tunnel(tunnelHTTP, clientName(r), r.Host, clientConn, destConn)
 }
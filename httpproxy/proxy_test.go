@@ -0,0 +1,28 @@
+package httpproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+)
+
+// newTestProxy creates proxy with discarded logs, it is shut down once the test ends
+func newTestProxy(t *testing.T, cfg *config.Config) *Proxy {
+	t.Helper()
+	log := logger.New()
+	log.SetOutput(ioutil.Discard)
+	p, err := New(cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+	return p
+}
@@ -0,0 +1,413 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+const (
+	defaultRetryBaseInterval = 25 * time.Millisecond
+	defaultRetryMaxInterval  = 250 * time.Millisecond
+	defaultReplayBodyLimit   = 1 << 20
+	defaultBudgetRatio       = 0.2
+	defaultBudgetPerSecond   = 3
+	defaultHedgeRequests     = 2
+	retryBudgetWindow        = 10 * time.Second
+)
+
+// errTryTimeout is returned if single try exceeds per-try timeout
+var errTryTimeout = errors.New("per-try timeout exceeded")
+
+// tryExpiredKey keeps flag set once per-try timeout cancels the attempt
+type tryExpiredKey struct{}
+
+// retryPolicy is a runtime state of the rule retry configuration
+type retryPolicy struct {
+	cfg          config.RuleRetry
+	connectError bool
+	timeout      bool
+	statuses     map[int]bool
+	budget       *retryBudget
+}
+
+// newRetryPolicy returns nil if rule neither repeats requests nor limits single tries
+func newRetryPolicy(cfg config.RuleRetry) (*retryPolicy, error) {
+	if cfg.Attempts == 0 && cfg.Hedge.Delay == 0 && cfg.PerTryTimeout == 0 {
+		return nil, nil
+	}
+	p := retryPolicy{
+		cfg:      cfg,
+		statuses: map[int]bool{},
+		budget:   newRetryBudget(cfg.Budget),
+	}
+	for _, on := range cfg.On {
+		switch on {
+		case "connect-error":
+			p.connectError = true
+		case "timeout":
+			p.timeout = true
+		case "5xx":
+			for code := 500; code < 600; code++ {
+				p.statuses[code] = true
+			}
+		case "gateway-error":
+			p.statuses[http.StatusBadGateway] = true
+			p.statuses[http.StatusServiceUnavailable] = true
+			p.statuses[http.StatusGatewayTimeout] = true
+		default:
+			code, err := strconv.Atoi(on)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("unsupported retry condition: %s", on)
+			}
+			p.statuses[code] = true
+		}
+	}
+	if p.cfg.BaseInterval <= 0 {
+		p.cfg.BaseInterval = defaultRetryBaseInterval
+	}
+	if p.cfg.MaxInterval <= 0 {
+		p.cfg.MaxInterval = defaultRetryMaxInterval
+	}
+	if p.cfg.ReplayBodyLimit <= 0 {
+		p.cfg.ReplayBodyLimit = defaultReplayBodyLimit
+	}
+	if p.cfg.Hedge.MaxRequests <= 0 {
+		p.cfg.Hedge.MaxRequests = defaultHedgeRequests
+	}
+	return &p, nil
+}
+
+// repeats checks if request might be sent more than once, otherwise only per-try timeout is applied
+func (p *retryPolicy) repeats() bool {
+	return p != nil && (p.cfg.Attempts > 0 || p.cfg.Hedge.Delay > 0)
+}
+
+// send passes request to the destination applying rule timeouts and retries
+func (s *Proxy) send(r *http.Request, rt *route) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if rt.rule.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), rt.rule.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+
+	p := rt.retry
+	if !p.repeats() {
+		res, err := s.attempt(ctx, r, nil, rt)
+		return withCancel(res, err, cancel)
+	}
+	body, replayable, err := replayableBody(r, p)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if !replayable {
+		res, err := s.attempt(ctx, r, body, rt)
+		return withCancel(res, err, cancel)
+	}
+
+	p.budget.request()
+	for try := 0; ; try++ {
+		res, err := s.hedge(ctx, r, body, rt)
+		if try >= p.cfg.Attempts || ctx.Err() != nil || !p.retriable(r, res, err) || !p.budget.retry() {
+			return withCancel(res, err, cancel)
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		s.log.WithField("try", try+1).
+			WithField("reason", retryReason(res, err)).
+			Debugf("%s %s: retrying", r.Method, r.URL)
+
+		select {
+		case <-time.After(p.backoff(try)):
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// hedge sends additional requests if destination does not respond in time, the first successful response wins
+func (s *Proxy) hedge(ctx context.Context, r *http.Request, body []byte, rt *route) (*http.Response, error) {
+	p := rt.retry
+	if p.cfg.Hedge.Delay <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return s.attempt(ctx, r, body, rt)
+	}
+
+	type result struct {
+		res *http.Response
+		err error
+		// index of the request in cancels
+		i int
+	}
+	results := make(chan result, p.cfg.Hedge.MaxRequests)
+	cancels := []context.CancelFunc{}
+	launch := func() {
+		tryCtx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := s.attempt(tryCtx, r, body, rt)
+			results <- result{res, err, i}
+		}()
+	}
+	// cancelOthers stops all requests except the returned one, its context is released once its body is closed
+	cancelOthers := func(out result) (*http.Response, error) {
+		for i, cancel := range cancels {
+			if i != out.i {
+				cancel()
+			}
+		}
+		return withCancel(out.res, out.err, cancels[out.i])
+	}
+
+	launch()
+	timer := time.NewTimer(p.cfg.Hedge.Delay)
+	defer timer.Stop()
+
+	var last result
+	for received := 0; received < len(cancels); {
+		select {
+		case <-timer.C:
+			if len(cancels) < p.cfg.Hedge.MaxRequests {
+				launch()
+				timer.Reset(p.cfg.Hedge.Delay)
+			}
+		case out := <-results:
+			received++
+			if out.err == nil && !p.statuses[out.res.StatusCode] {
+				// release responses of the rest of requests
+				for i := received; i < len(cancels); i++ {
+					go func() {
+						if late := <-results; late.res != nil {
+							late.res.Body.Close()
+						}
+					}()
+				}
+				if last.res != nil {
+					last.res.Body.Close()
+				}
+				return cancelOthers(out)
+			}
+			if last.res != nil {
+				last.res.Body.Close()
+			}
+			last = out
+		}
+	}
+	return cancelOthers(last)
+}
+
+// attempt sends a single copy of the request
+func (s *Proxy) attempt(ctx context.Context, r *http.Request, body []byte, rt *route) (*http.Response, error) {
+	var expired int32
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, tryExpiredKey{}, &expired))
+	req := r.Clone(ctx)
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	req = rt.route(req)
+
+	// per-try timeout limits time to response headers, body is streamed without it
+	if rt.retry != nil && rt.retry.cfg.PerTryTimeout > 0 {
+		timer := time.AfterFunc(rt.retry.cfg.PerTryTimeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	// open circuit rejects request without sending it
+	br := s.breakerFor(rt, req)
+	if br != nil {
+		if err := br.allow(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	res, err := s.roundTrip(req, rt.transport)
+	if err != nil {
+		gone := abandoned(ctx, err)
+		cancel()
+		switch {
+		case br == nil:
+		// cancelled request (hedging loser, gone client) says nothing about the destination
+		case gone:
+			br.release()
+		default:
+			// denied request does not reach the destination, so it is not its failure
+			br.done(!isAccessDenied(err))
+		}
+		if atomic.LoadInt32(&expired) == 1 {
+			return nil, errTryTimeout
+		}
+		return nil, err
+	}
+	failed := res.StatusCode >= 500
+	res.Body = &onCloseBody{ReadCloser: res.Body, onClose: func() {
+		cancel()
+		if br != nil {
+			br.done(failed)
+		}
+	}}
+	return res, nil
+}
+
+// retriable checks if request should be repeated according to the policy
+func (p *retryPolicy) retriable(r *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		if isAccessDenied(err) {
+			return false
+		}
+		if isConnectError(err) {
+			// request is not sent at all, so it is safe to repeat it regardless of the method
+			return p.connectError
+		}
+		if !p.cfg.NonIdempotent && !isIdempotent(r.Method) {
+			return false
+		}
+		return p.timeout && isTimeout(err)
+	}
+	if !p.cfg.NonIdempotent && !isIdempotent(r.Method) {
+		return false
+	}
+	return p.statuses[res.StatusCode]
+}
+
+// backoff returns random delay before the retry
+func (p *retryPolicy) backoff(try int) time.Duration {
+	d := p.cfg.BaseInterval << uint(try)
+	if d <= 0 || d > p.cfg.MaxInterval {
+		d = p.cfg.MaxInterval
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryBudget allows retries while they don't exceed specified share of requests
+type retryBudget struct {
+	ratio     float64
+	perWindow int
+
+	mu       sync.Mutex
+	started  time.Time
+	requests int
+	retries  int
+}
+
+func newRetryBudget(cfg config.RetryBudget) *retryBudget {
+	b := retryBudget{
+		ratio:     cfg.Ratio,
+		perWindow: cfg.MinPerSecond * int(retryBudgetWindow/time.Second),
+	}
+	if b.ratio == 0 {
+		b.ratio = defaultBudgetRatio
+	}
+	if cfg.MinPerSecond == 0 {
+		b.perWindow = defaultBudgetPerSecond * int(retryBudgetWindow/time.Second)
+	}
+	return &b
+}
+
+func (b *retryBudget) reset() {
+	if now := time.Now(); now.Sub(b.started) > retryBudgetWindow {
+		b.started = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+	b.requests++
+}
+
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+	if b.retries >= b.perWindow && float64(b.retries) >= b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// replayableBody reads request body to memory so it can be sent several times
+func replayableBody(r *http.Request, p *retryPolicy) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true, nil
+	}
+	if p == nil || r.ContentLength < 0 || r.ContentLength > p.cfg.ReplayBodyLimit {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+func withCancel(res *http.Response, err error, cancel context.CancelFunc) (*http.Response, error) {
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &onCloseBody{ReadCloser: res.Body, onClose: cancel}
+	return res, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// abandoned checks if request is cancelled because its result is not needed anymore:
+// another hedged request won or client has gone, per-try timeout is a failure though
+func abandoned(ctx context.Context, err error) bool {
+	if expired, ok := ctx.Value(tryExpiredKey{}).(*int32); ok && atomic.LoadInt32(expired) == 1 {
+		return false
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled)
+}
+
+func isTimeout(err error) bool {
+	if err == errTryTimeout || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func retryReason(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return strconv.Itoa(res.StatusCode)
+}
@@ -0,0 +1,150 @@
+package httpproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+func TestHedgeLoserIsNotCounted(t *testing.T) {
+	// body is larger than transport buffers, so it is streamed after the winner is chosen
+	body := bytes.Repeat([]byte("verdite "), 1<<19)
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request hangs until it is cancelled by the hedged one
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(t, &config.Config{
+		Upstreams: map[string]config.Upstream{
+			"app": {
+				Backends:       []config.Backend{{URL: backend.URL}},
+				CircuitBreaker: config.CircuitBreaker{ConsecutiveFailures: 1},
+				Outlier:        config.UpstreamOutlier{ConsecutiveErrors: 1},
+			},
+		},
+		Rules: []config.Rule{{
+			Match:    config.Matcher{Method: http.MethodGet, Path: "/app"},
+			Upstream: config.RuleUpstream{Name: "app"},
+			Retry:    config.RuleRetry{Hedge: config.RetryHedge{Delay: 20 * time.Millisecond}},
+		}},
+	})
+
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.local/app", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != len(body) {
+		t.Fatalf("expected hedged response of %d bytes, got %d of %d bytes", len(body), w.Code, w.Body.Len())
+	}
+
+	u := p.upstreams["app"]
+	b := u.backends[0]
+	// the loser finishes in background
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&b.active) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled request is not released")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := u.breaker.status(); st.State != "closed" || st.ConsecutiveFailures != 0 || st.Failures != 0 || st.Active != 0 {
+		t.Errorf("cancelled request is recorded by circuit breaker: %+v", st)
+	}
+	if n := atomic.LoadInt32(&b.consecutiveErr); n != 0 {
+		t.Errorf("cancelled request is recorded by outlier detection: %d consecutive errors", n)
+	}
+	if !b.available(time.Now().UnixNano()) {
+		t.Error("backend is ejected")
+	}
+}
+
+func TestPerTryTimeoutWithoutRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	policy, err := newRetryPolicy(config.RuleRetry{PerTryTimeout: 20 * time.Millisecond})
+	if err != nil || policy == nil {
+		t.Fatalf("per-try timeout is dropped: %v, %v", policy, err)
+	}
+	if policy.repeats() {
+		t.Error("policy without attempts and hedging repeats requests")
+	}
+
+	p := newTestProxy(t, &config.Config{
+		Access: config.Access{AllowPrivate: true},
+		Rules: []config.Rule{{
+			Match: config.Matcher{Method: http.MethodGet, Path: "/slow"},
+			Retry: config.RuleRetry{PerTryTimeout: 20 * time.Millisecond},
+		}},
+	})
+	started := time.Now()
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	if d := time.Since(started); d > 500*time.Millisecond {
+		t.Errorf("per-try timeout is not applied, request took %s", d)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.RetryBudget
+		requests int
+		allowed  int
+	}{
+		{"minimum per window", config.RetryBudget{Ratio: 0.1, MinPerSecond: 1}, 0, 10},
+		{"ratio above minimum", config.RetryBudget{Ratio: 0.5, MinPerSecond: 1}, 100, 50},
+		{"defaults", config.RetryBudget{}, 1000, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRetryBudget(tt.cfg)
+			for i := 0; i < tt.requests; i++ {
+				b.request()
+			}
+			allowed := 0
+			for i := 0; i < tt.requests+100; i++ {
+				if b.retry() {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("expected %d retries, got %d", tt.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p, err := newRetryPolicy(config.RuleRetry{Attempts: 5, BaseInterval: 10 * time.Millisecond, MaxInterval: 40 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for try, max := range []time.Duration{10, 20, 40, 40, 40} {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(try); d < 0 || d > max*time.Millisecond {
+				t.Fatalf("try %d: backoff %s exceeds %s", try, d, max*time.Millisecond)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+// route keeps runtime state of the rule: upstream it points to, retry policy, etc ...
+// requests not matching any rule use empty route which passes them "as is"
+type route struct {
+	rule      config.Rule
+	upstream  *upstream
+	retry     *retryPolicy
+	transport *transport
+	// interceptors called in order, pipelines are expanded
+	chain []*step
+}
+
+func (s *Proxy) newRoute(rule config.Rule) (*route, error) {
+	rt := route{
+		rule:      rule,
+		transport: s.transport,
+	}
+	if name := rule.Upstream.Name; name != "" {
+		u, ok := s.upstreams[name]
+		if !ok {
+			return nil, fmt.Errorf(`rule %s %s refers to unknown upstream "%s"`, rule.Match.Method, rule.Match.Path, name)
+		}
+		rt.upstream = u
+		rt.transport = u.transport
+	}
+
+	var err error
+	if rule.Parent != "" {
+		if s.transport.parents == nil {
+			err = fmt.Errorf(`unknown parent proxy "%s"`, rule.Parent)
+		} else {
+			err = s.transport.parents.check(rule.Parent)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %s %s: %w", rule.Match.Method, rule.Match.Path, err)
+		}
+	}
+	if rt.retry, err = newRetryPolicy(rule.Retry); err != nil {
+		return nil, fmt.Errorf("rule %s %s: %w", rule.Match.Method, rule.Match.Path, err)
+	}
+	// rule settings override upstream and global ones
+	if !isEmptyTransport(rule.Transport) {
+		if rt.transport, err = newTransport(mergeTransport(rt.transport.cfg, rule.Transport), rt.transport.parents, rt.transport.access); err != nil {
+			return nil, fmt.Errorf("rule %s %s: %w", rule.Match.Method, rule.Match.Path, err)
+		}
+	}
+	return &rt, nil
+}
+
+// route points request to the rule upstream if it is specified
+func (rt *route) route(r *http.Request) *http.Request {
+	if rt.upstream == nil {
+		return r
+	}
+	return rt.upstream.rewrite(r, rt.rule.Upstream)
+}
@@ -0,0 +1,100 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// connections keeps hijacked connections (tunnels, upgraded connections, SOCKS sessions) http.Server doesn't track
+type connections struct {
+	mu    sync.Mutex
+	items map[*[]io.Closer]struct{}
+	wg    sync.WaitGroup
+}
+
+func newConnections() *connections {
+	return &connections{
+		items: map[*[]io.Closer]struct{}{},
+	}
+}
+
+// add tracks connections until returned function is called
+func (c *connections) add(closers ...io.Closer) func() {
+	c.mu.Lock()
+	c.items[&closers] = struct{}{}
+	c.wg.Add(1)
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.items, &closers)
+			c.mu.Unlock()
+			c.wg.Done()
+		})
+	}
+}
+
+// wait blocks until all connections are released or context is done
+func (c *connections) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll interrupts connections which are still active
+func (c *connections) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for closers := range c.items {
+		for _, closer := range *closers {
+			closer.Close()
+		}
+	}
+}
+
+// Ready reports if proxy accepts new requests, it is not ready once shutdown is started
+func (s *Proxy) Ready() bool {
+	return atomic.LoadInt32(&s.draining) == 0
+}
+
+// Drain marks proxy as not ready, so load balancers stop sending new requests
+func (s *Proxy) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Shutdown waits for active tunnels and async interceptor calls until context is done, interrupts the rest of them,
+// stops health checks and closes plugin connections;
+// http requests are drained by http.Server.Shutdown
+func (s *Proxy) Shutdown(ctx context.Context) error {
+	s.Drain()
+	err := s.conns.wait(ctx)
+	if err != nil {
+		s.log.WithError(err).Warnln("Active tunnels are interrupted")
+		s.conns.closeAll()
+	}
+	// queued requests are sent to async interceptors while there is time left
+	if qerr := s.async.close(ctx); qerr != nil {
+		s.log.WithError(qerr).Warnln("Requests to async interceptors are dropped")
+	}
+	for _, u := range s.upstreams {
+		u.close()
+	}
+	for name, handler := range s.handlers {
+		if cerr := handler.Close(); cerr != nil {
+			s.log.WithError(cerr).Warnf(`Unable to close "%s" interceptor`, name)
+		}
+	}
+	return err
+}
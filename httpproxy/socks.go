@@ -0,0 +1,328 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/metrics"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksAuthNoMethod = 0xff
+
+	socksCmdConnect = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded        = 0
+	socksNotAllowed       = 2
+	socksHostUnreachable  = 4
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// socksServer accepts SOCKS5 tunnels, destinations are reached the same way as HTTP CONNECT ones
+type socksServer struct {
+	cfg       config.Socks
+	proxy     *Proxy
+	httpPorts map[int]bool
+}
+
+func newSocksServer(cfg config.Socks, proxy *Proxy) *socksServer {
+	s := socksServer{
+		cfg:       cfg,
+		proxy:     proxy,
+		httpPorts: map[int]bool{},
+	}
+	for _, port := range cfg.HTTPPorts {
+		s.httpPorts[port] = true
+	}
+	return &s
+}
+
+// ServeSOCKS accepts SOCKS5 connections on the listener until it is closed
+func (s *Proxy) ServeSOCKS(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.socks.serve(conn)
+	}
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer s.proxy.conns.add(conn)()
+	client := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+
+	user, err := s.authenticate(br, conn)
+	if err != nil {
+		s.proxy.log.WithField("client", client).WithError(err).Warnln("SOCKS5 handshake failed")
+		conn.Close()
+		return
+	}
+	addr, err := s.readRequest(br, conn)
+	if err != nil {
+		s.proxy.tunnelFailed(tunnelSOCKS, client, addr, err)
+		conn.Close()
+		return
+	}
+	if user != "" {
+		client = user + "@" + client
+	}
+	conn.SetDeadline(time.Time{})
+	var clientConn net.Conn = conn
+	if br.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: conn, r: br}
+	}
+
+	// plaintext HTTP is processed by the rules instead of being tunneled "as is"
+	_, port, _ := net.SplitHostPort(addr)
+	if p, _ := strconv.Atoi(port); s.httpPorts[p] {
+		metrics.Tunnels.WithLabelValues(tunnelSOCKS, "http").Inc()
+		s.proxy.log.WithField("protocol", tunnelSOCKS).WithField("client", client).
+			Infof("CONNECT %s: HTTP session is processed by rules", addr)
+		s.reply(conn, socksSucceeded, nil)
+		s.serveHTTP(clientConn, addr, user)
+		return
+	}
+
+	destConn, err := s.proxy.dialTunnel(context.Background(), s.proxy.direct, addr)
+	if err != nil {
+		s.proxy.tunnelFailed(tunnelSOCKS, client, addr, err)
+		code := byte(socksHostUnreachable)
+		if isAccessDenied(err) {
+			code = socksNotAllowed
+		}
+		s.reply(conn, code, nil)
+		conn.Close()
+		return
+	}
+	if err := s.reply(conn, socksSucceeded, destConn.LocalAddr()); err != nil {
+		s.proxy.tunnelFailed(tunnelSOCKS, client, addr, err)
+		destConn.Close()
+		conn.Close()
+		return
+	}
+	s.proxy.tunnel(tunnelSOCKS, client, addr, clientConn, destConn)
+}
+
+// authenticate negotiates authentication method and checks credentials if users are configured
+func (s *socksServer) authenticate(br *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+	// users of proxy authentication file are accepted if SOCKS users are not specified
+	var file *passwords
+	if s.proxy.auth != nil {
+		file = s.proxy.auth.passwords
+	}
+	method := byte(socksAuthNone)
+	if len(s.cfg.Users) > 0 || file != nil {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthNoMethod})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksAuthNone {
+		return "", nil
+	}
+
+	// username/password sub-negotiation
+	if _, err := io.ReadFull(br, header[:1]); err != nil {
+		return "", err
+	}
+	if header[0] != socksAuthVersion {
+		return "", fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	user, err := readString(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readString(br)
+	if err != nil {
+		return "", err
+	}
+	valid := false
+	if len(s.cfg.Users) > 0 {
+		expected, ok := s.cfg.Users[user]
+		valid = ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	} else {
+		valid = file.verify(user, password)
+	}
+	if !valid {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return "", fmt.Errorf(`invalid credentials of user "%s"`, user)
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, 0}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// readRequest returns destination address of CONNECT request, other commands are rejected
+func (s *socksServer) readRequest(br *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		domain, err := readString(br)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		s.reply(conn, socksAddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	if header[1] != socksCmdConnect {
+		s.reply(conn, socksCmdNotSupported, nil)
+		return addr, fmt.Errorf("unsupported command %d", header[1])
+	}
+	return addr, nil
+}
+
+// reply sends result of the request, bound address is reported if it is known
+func (s *socksServer) reply(conn net.Conn, code byte, bound net.Addr) error {
+	res := []byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		if ip := tcpAddr.IP.To4(); ip != nil {
+			copy(res[4:8], ip)
+		} else if ip := tcpAddr.IP.To16(); ip != nil {
+			res = append([]byte{socksVersion, code, 0, socksAddrIPv6}, ip...)
+			res = append(res, 0, 0)
+		}
+		binary.BigEndian.PutUint16(res[len(res)-2:], uint16(tcpAddr.Port))
+	}
+	_, err := conn.Write(res)
+	return err
+}
+
+// serveHTTP processes HTTP session sent through the tunnel by the rules, requests are sent to the tunnel destination
+func (s *socksServer) serveHTTP(conn net.Conn, addr, user string) {
+	l := &connListener{addr: conn.LocalAddr(), conn: conn, done: make(chan struct{})}
+	// client is already authenticated by SOCKS handshake, loops are checked as for the HTTP listener
+	handler := s.proxy.checkLoop(s.proxy.router)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = addr
+			handler.ServeHTTP(w, withUser(r, user))
+		}),
+		// listener is closed along with the only connection it has
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	server.Serve(l)
+}
+
+// connListener returns the only connection and blocks until it is closed
+type connListener struct {
+	addr net.Addr
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// readString reads string prefixed with its length
+func readString(br *bufio.Reader) (string, error) {
+	length, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,84 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/afoninsky/verdite/interceptor"
+)
+
+// actions of simulated requests
+const (
+	ActionForward  = "forward"
+	ActionResponse = "response"
+)
+
+type traceKey struct{}
+
+// Trace describes how the proxy handled simulated request
+type Trace struct {
+	// matched rule as "METHOD /path", empty if request is passed by default route
+	Rule string
+	// interceptors in order they are called
+	Chain []TraceStep
+	// forward: request is passed to the destination, response: proxy or interceptor answered it
+	Action string
+	// request as it is sent to the destination
+	Request *http.Request
+	// upstream request is routed to, if any
+	Upstream string
+	// response returned to the client if request is not forwarded
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// TraceStep describes interceptor answer
+type TraceStep struct {
+	Interceptor string
+	// IGNORE, FORWARD, RESPONSE, ASYNC (request is queued, answer is ignored) or error description
+	Result string
+}
+
+// Simulate passes request through authentication, rules and interceptors without sending it to the destination
+func (s *Proxy) Simulate(r *http.Request) *Trace {
+	t := Trace{}
+	r = r.WithContext(context.WithValue(r.Context(), traceKey{}, &t))
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	if t.Action == "" {
+		t.Action = ActionResponse
+		t.Status = w.Code
+		t.Header = w.Header()
+		t.Body = w.Body.Bytes()
+	}
+	return &t
+}
+
+// Stub replaces interceptor, so rules can be checked without plugins
+func (s *Proxy) Stub(name string, i interceptor.Interceptor) {
+	if prev, ok := s.handlers[name]; ok {
+		prev.Close()
+	}
+	s.handlers[name] = i
+}
+
+// requestTrace returns trace of simulated request, nil for real ones
+func requestTrace(r *http.Request) *Trace {
+	t, _ := r.Context().Value(traceKey{}).(*Trace)
+	return t
+}
+
+func (t *Trace) step(name string, result interface{}) {
+	t.Chain = append(t.Chain, TraceStep{Interceptor: name, Result: fmt.Sprint(result)})
+}
+
+func (t *Trace) forward(r *http.Request, rt *route) {
+	t.Action = ActionForward
+	t.Request = r
+	if rt.upstream != nil {
+		t.Upstream = rt.rule.Upstream.Name
+	}
+}
@@ -0,0 +1,300 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+	"golang.org/x/net/http2"
+)
+
+// transport defaults, the same as http.DefaultTransport ones
+const (
+	defaultDialTimeout         = 10 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+)
+
+// transport keeps connections to destinations
+type transport struct {
+	cfg     config.Transport
+	parents *parents
+	// destination policies, nil if destinations are not restricted (upstream backends)
+	access *access
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	// proxy from environment settings used if parents are not configured
+	envProxy func(r *http.Request) (*url.URL, error)
+	// negotiates HTTP/2 over TLS when destination supports it
+	http *http.Transport
+	// speaks HTTP/2 over cleartext connections (prior knowledge)
+	h2c *http2.Transport
+}
+
+func newTransport(cfg config.Transport, parents *parents, acl *access) (*transport, error) {
+	t := transport{
+		cfg:      cfg,
+		parents:  parents,
+		access:   acl,
+		envProxy: http.ProxyFromEnvironment,
+	}
+
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	keepAlive := cfg.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+	if cfg.SourceAddress != "" {
+		ip := net.ParseIP(cfg.SourceAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address: %s", cfg.SourceAddress)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	hosts := map[string]string{}
+	for name, ip := range cfg.Hosts {
+		hosts[strings.ToLower(name)] = ip
+	}
+	t.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := splitHostPort(addr)
+		switch {
+		// destinations which can't be checked (named ports, etc ...) are not dialed
+		case err != nil && t.access != nil:
+			return nil, err
+		case err != nil:
+			return dialer.DialContext(ctx, network, addr)
+		}
+		target := host
+		if ip, ok := hosts[strings.ToLower(host)]; ok {
+			target = ip
+		}
+		// parent proxies are defined by configuration, so they are not restricted
+		if t.access == nil || t.parents.isParent(addr) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(target, strconv.Itoa(port)))
+		}
+		return t.access.dial(ctx, dialer.DialContext, network, host, target, port)
+	}
+
+	tlsConfig, err := newClientTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	t.http = &http.Transport{
+		Proxy:                 t.proxyURL,
+		DialContext:           t.dial,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+	if parents != nil {
+		t.http.ProxyConnectHeader = http.Header{"Via": {"1.1 " + parents.via}}
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		t.http.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.http.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConns > 0 {
+		t.http.MaxIdleConns = cfg.MaxIdleConns
+	}
+
+	t.h2c = &http2.Transport{
+		AllowHTTP: true,
+		// cleartext connection is dialed within the request context, so cancelled requests don't wait for it
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return t.dialVia(ctx, network, addr)
+		},
+	}
+	return &t, nil
+}
+
+// proxyURL returns parent proxy for the request, environment settings are used if parents are not configured
+func (t *transport) proxyURL(r *http.Request) (*url.URL, error) {
+	var parent *url.URL
+	if t.parents == nil {
+		env, err := t.envProxy(r)
+		if err != nil {
+			return nil, err
+		}
+		parent = env
+	} else {
+		parent = t.parents.pick(r.Context(), r.URL.Hostname())
+	}
+	// destination is resolved by the parent, so only its name is checked
+	if parent != nil && t.access != nil {
+		if err := t.access.checkAddr(hostPort(r.URL)); err != nil {
+			return nil, err
+		}
+	}
+	return parent, nil
+}
+
+// newClientTLSConfig returns TLS settings of connections to destinations
+func newClientTLSConfig(cfg config.TransportTLS) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CA)
+		}
+		c.RootCAs = pool
+	}
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate %s: %w", cfg.Cert, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// mergeTransport returns settings where specified override fields replace base ones
+func mergeTransport(base, override config.Transport) config.Transport {
+	res := base
+	if override.DialTimeout != 0 {
+		res.DialTimeout = override.DialTimeout
+	}
+	if override.KeepAlive != 0 {
+		res.KeepAlive = override.KeepAlive
+	}
+	if override.TLSHandshakeTimeout != 0 {
+		res.TLSHandshakeTimeout = override.TLSHandshakeTimeout
+	}
+	if override.ResponseHeaderTimeout != 0 {
+		res.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.IdleConnTimeout != 0 {
+		res.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.MaxIdleConns != 0 {
+		res.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.MaxIdleConnsPerHost != 0 {
+		res.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.MaxConnsPerHost != 0 {
+		res.MaxConnsPerHost = override.MaxConnsPerHost
+	}
+	if override.SourceAddress != "" {
+		res.SourceAddress = override.SourceAddress
+	}
+	if len(override.Hosts) > 0 {
+		res.Hosts = map[string]string{}
+		for k, v := range base.Hosts {
+			res.Hosts[k] = v
+		}
+		for k, v := range override.Hosts {
+			res.Hosts[k] = v
+		}
+	}
+	if override.TLS != (config.TransportTLS{}) {
+		res.TLS = override.TLS
+	}
+	return res
+}
+
+// isEmptyTransport checks if no settings are specified
+func isEmptyTransport(cfg config.Transport) bool {
+	return cfg.DialTimeout == 0 && cfg.KeepAlive == 0 && cfg.TLSHandshakeTimeout == 0 &&
+		cfg.ResponseHeaderTimeout == 0 && cfg.IdleConnTimeout == 0 && cfg.MaxIdleConns == 0 &&
+		cfg.MaxIdleConnsPerHost == 0 && cfg.MaxConnsPerHost == 0 && cfg.SourceAddress == "" &&
+		len(cfg.Hosts) == 0 && cfg.TLS == (config.TransportTLS{})
+}
+
+// isGRPC checks if request carries gRPC call
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// roundTrip sends request to the destination using transport suitable for it
+func (s *Proxy) roundTrip(r *http.Request, t *transport) (*http.Response, error) {
+	// HTTP/2 requests contain origin-form url, so destination is taken from the authority
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
+		if r.URL.Scheme == "" {
+			r.URL.Scheme = "http"
+		}
+	}
+	var rt http.RoundTripper = t.http
+	// gRPC requires HTTP/2, so it is sent as h2c to cleartext destinations
+	if isGRPC(r) && r.URL.Scheme == "http" {
+		rt = t.h2c
+	}
+
+	b := requestBackend(r)
+	if b == nil {
+		return rt.RoundTrip(r)
+	}
+
+	// upstream backend is busy until response is read completely
+	b.begin()
+	res, err := rt.RoundTrip(r)
+	if err != nil {
+		if abandoned(r.Context(), err) {
+			b.release()
+		} else {
+			b.end(0, err)
+		}
+		return nil, err
+	}
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		b.end(res.StatusCode, nil)
+		return res, nil
+	}
+	status := res.StatusCode
+	res.Body = &onCloseBody{ReadCloser: res.Body, onClose: func() {
+		b.end(status, nil)
+	}}
+	return res, nil
+}
+
+// onCloseBody calls hook once response body is closed (request context is released, backend is not busy, etc ...)
+type onCloseBody struct {
+	io.ReadCloser
+	onClose func()
+	once    sync.Once
+}
+
+func (b *onCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
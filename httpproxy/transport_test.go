@@ -0,0 +1,83 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/afoninsky/verdite/config"
+)
+
+func TestH2CDialIsCancelled(t *testing.T) {
+	tr, err := newTransport(config.Transport{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan error, 1)
+	// destination never answers, dial ends only once the request is cancelled
+	tr.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case <-ctx.Done():
+			dialed <- ctx.Err()
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			dialed <- nil
+			return nil, errors.New("dial timeout")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://grpc.local/service/Method", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	if _, err := tr.h2c.RoundTrip(r); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(started); d > time.Second {
+		t.Errorf("request waits for dial: %s", d)
+	}
+	select {
+	case err := <-dialed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("dial doesn't get request context: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("dial is not cancelled")
+	}
+}
+
+func TestEnvProxyIsChecked(t *testing.T) {
+	acl, err := newAccess(config.Access{
+		Default: accessDeny,
+		Rules:   []config.AccessRule{{Action: accessAllow, Hosts: []string{"*.example.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTransport(config.Transport{}, nil, acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, _ := url.Parse("http://proxy.local:3128")
+	tr.envProxy = func(*http.Request) (*url.URL, error) {
+		return env, nil
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	if u, err := tr.proxyURL(r); err != nil || u != env {
+		t.Errorf("allowed destination is not sent to the proxy: %v, %v", u, err)
+	}
+	// the proxy connects to the destination itself, so it is checked before the request is passed on
+	r = httptest.NewRequest(http.MethodGet, "http://internal.local/", nil)
+	if _, err := tr.proxyURL(r); !isAccessDenied(err) {
+		t.Errorf("denied destination is sent to the proxy: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/afoninsky/verdite/metrics"
+)
+
+// protocols clients request tunnels with
+const (
+	tunnelHTTP  = "http"
+	tunnelSOCKS = "socks5"
+)
+
+// dialTunnel connects to the tunnel destination, breaker of the destination host is respected
+func (s *Proxy) dialTunnel(ctx context.Context, rt *route, addr string) (net.Conn, error) {
+	br := s.breakers.get(addr)
+	if br != nil {
+		if err := br.allow(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := rt.transport.dialVia(ctx, "tcp", addr)
+	switch {
+	case br == nil:
+	case err != nil && abandoned(ctx, err):
+		br.release()
+	default:
+		// tunnel occupies concurrency slot until dial completes
+		br.done(err != nil && !isAccessDenied(err))
+	}
+	return conn, err
+}
+
+// tunnel pumps data between client and destination until one of them closes connection,
+// tunnels of all protocols are logged and measured the same way
+func (s *Proxy) tunnel(protocol, client, addr string, clientConn io.ReadWriteCloser, destConn net.Conn) {
+	defer s.conns.add(clientConn, destConn)()
+	started := time.Now()
+	metrics.Tunnels.WithLabelValues(protocol, "established").Inc()
+	metrics.TunnelsActive.WithLabelValues(protocol).Inc()
+	defer metrics.TunnelsActive.WithLabelValues(protocol).Dec()
+
+	received := make(chan int64, 1)
+	go func() {
+		received <- transfer(clientConn, destConn)
+	}()
+	sent := transfer(destConn, clientConn)
+	recv := <-received
+
+	metrics.TunnelBytes.WithLabelValues(protocol, "sent").Add(float64(sent))
+	metrics.TunnelBytes.WithLabelValues(protocol, "received").Add(float64(recv))
+	s.log.WithField("protocol", protocol).
+		WithField("client", client).
+		WithField("sent", sent).
+		WithField("received", recv).
+		WithField("duration", time.Since(started).String()).
+		Infof("CONNECT %s", addr)
+}
+
+// tunnelFailed logs and measures tunnel which was not established
+func (s *Proxy) tunnelFailed(protocol, client, addr string, err error) {
+	var accErr *accessError
+	if errors.As(err, &accErr) {
+		metrics.Tunnels.WithLabelValues(protocol, "denied").Inc()
+		s.log.WithField("protocol", protocol).
+			WithField("client", client).
+			WithField("access", accErr.rule).
+			Warnf("CONNECT %s: destination is denied", addr)
+		return
+	}
+	metrics.Tunnels.WithLabelValues(protocol, "failed").Inc()
+	s.log.WithField("protocol", protocol).
+		WithField("client", client).
+		WithError(err).
+		Warnf("CONNECT %s: tunnel is not established", addr)
+}
+
+// transfer copies data until source is drained or any side fails, both sides are closed afterwards
+func transfer(destination io.WriteCloser, source io.ReadCloser) int64 {
+	defer destination.Close()
+	defer source.Close()
+	n, _ := io.Copy(destination, source)
+	return n
+}
+
+// streamConn represents HTTP/2 stream as a connection: request body is read, response is written
+type streamConn struct {
+	io.ReadCloser
+	w http.ResponseWriter
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,252 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/metrics"
+)
+
+const defaultEjectionTime = 30 * time.Second
+
+type backendKey struct{}
+
+// upstream is a named group of backends requests are routed to in reverse proxy mode
+type upstream struct {
+	name      string
+	cfg       config.Upstream
+	log       *logger.Logger
+	backends  []*backend
+	balancer  balancer
+	breaker   *breaker
+	transport *transport
+	// closed to stop health checks
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// backend keeps state of the single upstream host
+type backend struct {
+	upstream *upstream
+	url      *url.URL
+	// backend url without credentials used in metrics and logs, backends might share the host
+	label  string
+	weight int
+
+	active         int64
+	healthy        int32
+	ejectedUntil   int64
+	consecutive5xx int32
+	consecutiveErr int32
+}
+
+func newUpstream(name string, cfg config.Upstream, shared *transport, log *logger.Logger) (*upstream, error) {
+	u := upstream{
+		name: name,
+		cfg:  cfg,
+		log:  log,
+		done: make(chan struct{}),
+	}
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf(`upstream "%s" has no backends`, name)
+	}
+	for _, b := range cfg.Backends {
+		target, err := url.Parse(b.URL)
+		if err != nil {
+			return nil, fmt.Errorf(`upstream "%s": %w`, name, err)
+		}
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return nil, fmt.Errorf(`upstream "%s": backend "%s" should be absolute http(s) url`, name, b.URL)
+		}
+		weight := b.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		label := *target
+		label.User = nil
+		b := &backend{
+			upstream: &u,
+			url:      target,
+			label:    label.String(),
+			weight:   weight,
+			healthy:  1,
+		}
+		u.backends = append(u.backends, b)
+		metrics.BackendHealthy.WithLabelValues(name, b.label).Set(1)
+		metrics.BackendEjected.WithLabelValues(name, b.label).Set(0)
+	}
+
+	var err error
+	if u.balancer, err = newBalancer(cfg.Balancing); err != nil {
+		return nil, fmt.Errorf(`upstream "%s": %w`, name, err)
+	}
+
+	// upstream settings override global ones, backends are defined by configuration,
+	// so destination access rules are not applied to them
+	if u.transport, err = newTransport(mergeTransport(shared.cfg, cfg.Transport), shared.parents, nil); err != nil {
+		return nil, fmt.Errorf(`upstream "%s": %w`, name, err)
+	}
+
+	if cfg.CircuitBreaker.Enabled() {
+		u.breaker = newBreaker("upstream/"+name, cfg.CircuitBreaker)
+	}
+
+	if cfg.HealthCheck.Path != "" {
+		go u.healthCheck(u.transport.http)
+	}
+	return &u, nil
+}
+
+// close stops health checks
+func (u *upstream) close() {
+	u.closeOnce.Do(func() {
+		close(u.done)
+	})
+}
+
+// pick returns backend for the request skipping unhealthy and ejected ones,
+// all backends are used if none of them is available
+func (u *upstream) pick(r *http.Request) *backend {
+	now := time.Now().UnixNano()
+	candidates := make([]*backend, 0, len(u.backends))
+	for _, b := range u.backends {
+		if b.available(now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = u.backends
+	}
+	return u.balancer.pick(candidates, r)
+}
+
+// rewrite points request to the backend, original destination is kept in X-Forwarded-* headers
+func (u *upstream) rewrite(r *http.Request, cfg config.RuleUpstream) *http.Request {
+	b := u.pick(r)
+	target := b.url
+
+	path := stripPrefix(r.URL.Path, cfg.StripPrefix)
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = joinPath(target.Path, path)
+	r.URL.RawPath = ""
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = target.RawQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+	if !cfg.PreserveHost {
+		r.Host = target.Host
+	}
+
+	// backend is notified about request result once it is sent
+	return r.WithContext(context.WithValue(r.Context(), backendKey{}, b))
+}
+
+// requestBackend returns backend request is routed to, if any
+func requestBackend(r *http.Request) *backend {
+	b, _ := r.Context().Value(backendKey{}).(*backend)
+	return b
+}
+
+func (b *backend) available(now int64) bool {
+	return atomic.LoadInt32(&b.healthy) == 1 && atomic.LoadInt64(&b.ejectedUntil) < now
+}
+
+// begin marks request as in-flight
+func (b *backend) begin() {
+	atomic.AddInt64(&b.active, 1)
+	metrics.BackendActiveRequests.WithLabelValues(b.upstream.name, b.label).Inc()
+}
+
+// release marks request as finished without recording its result
+func (b *backend) release() {
+	atomic.AddInt64(&b.active, -1)
+	metrics.BackendActiveRequests.WithLabelValues(b.upstream.name, b.label).Dec()
+}
+
+// end marks request as finished, its result is used by outlier detection
+func (b *backend) end(status int, err error) {
+	b.release()
+
+	cfg := b.upstream.cfg.Outlier
+	switch {
+	case err != nil:
+		metrics.BackendRequests.WithLabelValues(b.upstream.name, b.label, "error").Inc()
+		atomic.StoreInt32(&b.consecutive5xx, 0)
+		n := atomic.AddInt32(&b.consecutiveErr, 1)
+		if cfg.ConsecutiveErrors > 0 && int(n) >= cfg.ConsecutiveErrors {
+			b.eject("consecutive-errors")
+		}
+	case status >= 500:
+		metrics.BackendRequests.WithLabelValues(b.upstream.name, b.label, strconv.Itoa(status)).Inc()
+		atomic.StoreInt32(&b.consecutiveErr, 0)
+		n := atomic.AddInt32(&b.consecutive5xx, 1)
+		if cfg.Consecutive5xx > 0 && int(n) >= cfg.Consecutive5xx {
+			b.eject("consecutive-5xx")
+		}
+	default:
+		metrics.BackendRequests.WithLabelValues(b.upstream.name, b.label, strconv.Itoa(status)).Inc()
+		atomic.StoreInt32(&b.consecutiveErr, 0)
+		atomic.StoreInt32(&b.consecutive5xx, 0)
+	}
+}
+
+// eject excludes backend from balancing for a while
+func (b *backend) eject(reason string) {
+	duration := b.upstream.cfg.Outlier.EjectionTime
+	if duration <= 0 {
+		duration = defaultEjectionTime
+	}
+	now := time.Now().UnixNano()
+	prev := atomic.LoadInt64(&b.ejectedUntil)
+	if prev > now || !atomic.CompareAndSwapInt64(&b.ejectedUntil, prev, now+int64(duration)) {
+		// already ejected
+		return
+	}
+	atomic.StoreInt32(&b.consecutiveErr, 0)
+	atomic.StoreInt32(&b.consecutive5xx, 0)
+
+	metrics.BackendEjections.WithLabelValues(b.upstream.name, b.label, reason).Inc()
+	metrics.BackendEjected.WithLabelValues(b.upstream.name, b.label).Set(1)
+	time.AfterFunc(duration, func() {
+		metrics.BackendEjected.WithLabelValues(b.upstream.name, b.label).Set(0)
+	})
+	b.upstream.log.WithField("upstream", b.upstream.name).
+		WithField("reason", reason).
+		Warnf("Backend %s ejected for %s", b.label, duration)
+}
+
+// stripPrefix removes leading path segments: "/api" is removed from "/api" and "/api/users", but not from "/apiary"
+func stripPrefix(path, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || (path != prefix && !strings.HasPrefix(path, prefix+"/")) {
+		return path
+	}
+	path = strings.TrimPrefix(path, prefix)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
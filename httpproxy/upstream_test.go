@@ -0,0 +1,26 @@
+package httpproxy
+
+import "testing"
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		result string
+	}{
+		{"/api/users", "/api", "/users"},
+		{"/api/users", "/api/", "/users"},
+		{"/api", "/api", "/"},
+		{"/api/", "/api", "/"},
+		{"/apiary", "/api", "/apiary"},
+		{"/apiary/bees", "/api/", "/apiary/bees"},
+		{"/v1/api/users", "/api", "/v1/api/users"},
+		{"/users", "", "/users"},
+		{"/users", "/", "/users"},
+	}
+	for _, tt := range tests {
+		if res := stripPrefix(tt.path, tt.prefix); res != tt.result {
+			t.Errorf("%s without %s: expected %s, got %s", tt.path, tt.prefix, tt.result, res)
+		}
+	}
+}
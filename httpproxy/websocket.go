@@ -0,0 +1,199 @@
+package httpproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocket frame opcodes used in logs
+var wsOpcodes = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xA: "pong",
+}
+
+// isUpgrade checks if client asks to switch protocol (websocket handshake and similar)
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken checks if comma-separated header contains specified token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeForwarder passes handshake to the destination and, if it switches protocols,
+// turns both connections into a bidirectional tunnel
+func (s *Proxy) upgradeForwarder(w http.ResponseWriter, r *http.Request, rt *route) {
+	cfg := rt.rule.WebSocket
+	res, err := s.roundTrip(r, rt.transport)
+	if err != nil {
+		if isAccessDenied(err) {
+			s.upstreamError(w, r, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// destination refused to upgrade: return its answer as a regular response
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer res.Body.Close()
+		s.headers.prepareResponse(res)
+		copyHeaders(w.Header(), res.Header)
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		http.Error(w, "destination connection is not upgradable", http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer clientConn.Close()
+	defer s.conns.add(clientConn, backConn)()
+
+	// complete handshake on the client side
+	addVia(res.Header, res.ProtoMajor, res.ProtoMinor, s.headers.via)
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	var logFrames bool
+	if cfg.LogMessages && strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		logFrames = true
+	}
+
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			clientConn.Close()
+			backConn.Close()
+		})
+	}
+
+	// close tunnel if nothing is transferred in both directions for a while
+	touch := func() {}
+	if cfg.IdleTimeout > 0 {
+		timer := time.AfterFunc(cfg.IdleTimeout, closeAll)
+		defer timer.Stop()
+		touch = func() { timer.Reset(cfg.IdleTimeout) }
+	}
+
+	pump := func(dst io.Writer, src io.Reader, direction string) {
+		src = activityReader{src, touch}
+		if logFrames {
+			copyFrames(dst, src, func(fin bool, opcode byte, size uint64) {
+				s.log.WithField("url", r.URL.String()).
+					WithField("direction", direction).
+					WithField("fin", fin).
+					Infof("WebSocket %s message: %d bytes", wsOpcodeName(opcode), size)
+			})
+		} else {
+			io.Copy(dst, src)
+		}
+		closeAll()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pump(clientConn, backConn, "downstream")
+		close(done)
+	}()
+	// client reader might contain data buffered before hijacking
+	pump(backConn, brw.Reader, "upstream")
+	<-done
+}
+
+// activityReader notifies about every successful read
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+// copyFrames copies websocket frames from src to dst calling onFrame for each of them
+func copyFrames(dst io.Writer, src io.Reader, onFrame func(fin bool, opcode byte, size uint64)) error {
+	header := make([]byte, 14)
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		n := 2
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return err
+			}
+			size = uint64(binary.BigEndian.Uint16(header[n : n+2]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return err
+			}
+			size = binary.BigEndian.Uint64(header[n : n+8])
+			n += 8
+		}
+		// masking key
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return err
+			}
+			n += 4
+		}
+		if _, err := dst.Write(header[:n]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, int64(size)); err != nil {
+			return err
+		}
+		onFrame(header[0]&0x80 != 0, header[0]&0x0f, size)
+	}
+}
+
+func wsOpcodeName(opcode byte) string {
+	if name, ok := wsOpcodes[opcode]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -1,10 +1,12 @@
 // Package forward implements http request interceptor with the following defaults:
 // 	- request marked as allowed to proceed
 // 	- request entities are added if specified
+// 	- rule arguments override configured method, url, body and headers ("headers.<name>")
 package forward
 
 import (
 	"context"
+	"strings"
 
 	"github.com/afoninsky/verdite/config"
 	"github.com/afoninsky/verdite/proto"
@@ -40,9 +42,27 @@ func (s Plugin) OnRequest(ctx context.Context, in *proto.OnRequestInput) (*proto
 		httpReq.Headers[k] = v
 	}
 
+	for k, v := range in.Params {
+		switch {
+		case k == "method":
+			httpReq.Method = v
+		case k == "url":
+			httpReq.URL = v
+		case k == "body":
+			httpReq.Body = []byte(v)
+		case strings.HasPrefix(k, "headers."):
+			httpReq.Headers[strings.TrimPrefix(k, "headers.")] = v
+		}
+	}
+
 	res := proto.OnRequestOutput{
 		Action: proto.OnRequestOutput_FORWARD,
 		Req:    &httpReq,
 	}
 	return &res, nil
 }
+
+// Close ...
+func (s Plugin) Close() error {
+	return nil
+}
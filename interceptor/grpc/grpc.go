@@ -10,6 +10,7 @@ import (
 
 // Plugin ...
 type Plugin struct {
+	conn   *grpc.ClientConn
 	client proto.InterceptorClient
 }
 
@@ -20,6 +21,7 @@ func New(name string, cfg config.Interceptor) (Plugin, error) {
 	if err != nil {
 		return s, err
 	}
+	s.conn = conn
 	s.client = proto.NewInterceptorClient(conn)
 
 	return s, nil
@@ -29,3 +31,8 @@ func New(name string, cfg config.Interceptor) (Plugin, error) {
 func (s Plugin) OnRequest(ctx context.Context, in *proto.OnRequestInput) (*proto.OnRequestOutput, error) {
 	return s.client.OnRequest(ctx, in)
 }
+
+// Close closes connection to the plugin
+func (s Plugin) Close() error {
+	return s.conn.Close()
+}
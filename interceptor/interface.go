@@ -14,6 +14,8 @@ import (
 // Interceptor describes interceptor plugin interface
 type Interceptor interface {
 	OnRequest(context.Context, *proto.OnRequestInput) (*proto.OnRequestOutput, error)
+	// Close releases plugin resources (connections, etc ...)
+	Close() error
 }
 
 // New ...
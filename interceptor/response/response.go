@@ -1,10 +1,13 @@
 // Package response implements http request interceptor with the following defaults:
 // 	- request marked as allowed to proceed
 // 	- request entities are added if specified
+// 	- rule arguments override configured status, body and headers ("headers.<name>")
 package response
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	"github.com/afoninsky/verdite/config"
 	"github.com/afoninsky/verdite/proto"
@@ -37,9 +40,28 @@ func (s Plugin) OnRequest(ctx context.Context, in *proto.OnRequestInput) (*proto
 		httpRes.Headers[k] = v
 	}
 
+	for k, v := range in.Params {
+		switch {
+		case k == "status":
+			// arguments are validated with configuration
+			if status, err := strconv.Atoi(v); err == nil {
+				httpRes.Status = uint32(status)
+			}
+		case k == "body":
+			httpRes.Body = []byte(v)
+		case strings.HasPrefix(k, "headers."):
+			httpRes.Headers[strings.TrimPrefix(k, "headers.")] = v
+		}
+	}
+
 	res := proto.OnRequestOutput{
 		Action: proto.OnRequestOutput_RESPONSE,
 		Res:    &httpRes,
 	}
 	return &res, nil
 }
+
+// Close ...
+func (s Plugin) Close() error {
+	return nil
+}
@@ -0,0 +1,234 @@
+// Package listeners implements inheritance of listening sockets, so connections are not refused on restart:
+// 	- systemd socket activation (LISTEN_FDS, LISTEN_FDNAMES)
+// 	- handoff to the new process on binary upgrade, the old one lets go once the new one is ready
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+)
+
+// environment describing inherited sockets
+const (
+	envHandoffNames = "VERDITE_HANDOFF_FDS"
+	envHandoffReady = "VERDITE_HANDOFF_READY"
+	envSystemdPID   = "LISTEN_PID"
+	envSystemdFDs   = "LISTEN_FDS"
+	envSystemdNames = "LISTEN_FDNAMES"
+)
+
+// first inherited descriptor (after stdin, stdout and stderr)
+const firstFD = 3
+
+// how long the new process is waited for
+const upgradeTimeout = time.Minute
+
+// systemd names sockets "unknown" if FileDescriptorName is not specified, such sockets are matched by order
+var defaultNames = []string{"http", "socks", "admin"}
+
+// Set keeps listeners by name
+type Set struct {
+	log *logger.Logger
+
+	mu        sync.Mutex
+	active    map[string]net.Listener
+	inherited map[string]net.Listener
+	ready     *os.File
+}
+
+// New picks up sockets inherited from the previous process or systemd
+func New(log *logger.Logger) (*Set, error) {
+	s := Set{
+		log:       log,
+		active:    map[string]net.Listener{},
+		inherited: map[string]net.Listener{},
+	}
+
+	var names []string
+	if v := os.Getenv(envHandoffNames); v != "" {
+		names = strings.Split(v, ",")
+		fd, err := strconv.Atoi(os.Getenv(envHandoffReady))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envHandoffReady, err)
+		}
+		s.ready = os.NewFile(uintptr(fd), "ready")
+	} else if pid, _ := strconv.Atoi(os.Getenv(envSystemdPID)); pid == os.Getpid() {
+		count, err := strconv.Atoi(os.Getenv(envSystemdFDs))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envSystemdFDs, err)
+		}
+		names = make([]string, count)
+		systemdNames := strings.Split(os.Getenv(envSystemdNames), ":")
+		for i := range names {
+			if i < len(systemdNames) && systemdNames[i] != "" && systemdNames[i] != "unknown" {
+				names[i] = systemdNames[i]
+			} else if i < len(defaultNames) {
+				names[i] = defaultNames[i]
+			}
+		}
+	}
+	for _, env := range []string{envHandoffNames, envHandoffReady, envSystemdPID, envSystemdFDs, envSystemdNames} {
+		os.Unsetenv(env)
+	}
+
+	for i, name := range names {
+		f := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf(`unable to inherit "%s" listener: %w`, name, err)
+		}
+		s.inherited[name] = l
+		log.WithField("address", l.Addr().String()).Infof(`Listener "%s" inherited`, name)
+	}
+	return &s, nil
+}
+
+// Listen returns inherited listener or creates new one if there is no such or its address has changed
+func (s *Set) Listen(name, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		if sameAddr(l.Addr(), addr) {
+			s.active[name] = l
+			return l, nil
+		}
+		l.Close()
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.active[name] = l
+	return l, nil
+}
+
+// Ready closes inherited listeners which are not used anymore and notifies the previous process it can let go
+func (s *Set) Ready() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, l := range s.inherited {
+		l.Close()
+		delete(s.inherited, name)
+	}
+	if s.ready == nil {
+		return nil
+	}
+	defer func() {
+		s.ready.Close()
+		s.ready = nil
+	}()
+	_, err := s.ready.Write([]byte("ok"))
+	return err
+}
+
+// Upgrade starts new process inheriting the listeners and waits until it is ready;
+// error means the new process failed (invalid config, etc ...) and the current one should keep serving
+func (s *Set) Upgrade() error {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.active))
+	for name := range s.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*os.File, 0, len(names))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		filer, ok := s.active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			s.mu.Unlock()
+			return fmt.Errorf(`listener "%s" can't be passed to the new process`, name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		w.Close()
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		envHandoffNames+"="+strings.Join(names, ","),
+		envHandoffReady+"="+strconv.Itoa(firstFD+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return err
+	}
+	w.Close()
+
+	// the new process writes to the pipe once it serves traffic, pipe is closed without data if it exits
+	result := make(chan error, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		if string(data) == "ok" {
+			result <- nil
+			return
+		}
+		result <- errors.New("new process exited before it became ready")
+	}()
+	go cmd.Wait()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+		s.log.WithField("pid", cmd.Process.Pid).Infoln("New process is ready")
+		return nil
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process is not ready in %s", upgradeTimeout)
+	}
+}
+
+// sameAddr checks if listener address matches configured one
+func sameAddr(la net.Addr, addr string) bool {
+	tcp, ok := la.(*net.TCPAddr)
+	if !ok {
+		return la.String() == addr
+	}
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || resolved.Port != tcp.Port {
+		return false
+	}
+	if resolved.IP == nil || resolved.IP.IsUnspecified() {
+		return tcp.IP.IsUnspecified()
+	}
+	return resolved.IP.Equal(tcp.IP)
+}
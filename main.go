@@ -1,30 +1,56 @@
 package main
 
 import (
-	"crypto/tls"
-	"net/http"
-
-	"github.com/afoninsky/utilities/pkg/logger"
-	"github.com/afoninsky/verdite/config"
-	"github.com/afoninsky/verdite/httpproxy"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
 )
 
-func main() {
-	log := logger.New()
+const defaultConfig = "./config.yaml"
+
+const usage = `Usage: verdite [command] [flags]
 
-	cfg, err := config.New("./config.yaml")
-	log.FatalIfErr(err)
+Commands:
+  serve     start the proxy (default)
+  validate  check configuration file
+  routes    print routing table
+  test      check rules against sample requests
+  version   print build information
 
-	proxy, err := httpproxy.New(cfg)
-	log.FatalIfErr(err)
+Run "verdite <command> -h" to list command flags.
+`
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "validate":
+		os.Exit(validate(args))
+	case "routes":
+		os.Exit(routes(args))
+	case "test":
+		os.Exit(test(args))
+	case "version":
+		version()
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command \"%s\"\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
 
-	server := &http.Server{
-		Addr: cfg.Listen,
-		// Handler: http.HandlerFunc(proxy.Handler),
-		Handler: proxy.Handler(),
-		// disable HTTP/2 support
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+// configFlag adds configuration file flag, CONFIG environment variable is used by default
+func configFlag(fs *flag.FlagSet) *string {
+	path := os.Getenv("CONFIG")
+	if path == "" {
+		path = defaultConfig
 	}
-	log.WithField("address", cfg.Listen).Infoln("HTTP/1.0 proxy server started")
-	log.Fatal(server.ListenAndServe())
+	return fs.String("config", path, "configuration file, directory or glob pattern (CONFIG)")
 }
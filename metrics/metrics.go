@@ -0,0 +1,133 @@
+// Package metrics contains prometheus collectors exposed by the admin listener
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "verdite"
+
+var (
+	// BackendHealthy reports result of active health checks
+	BackendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_backend_healthy",
+		Help:      "Whether backend passes active health checks.",
+	}, []string{"upstream", "backend"})
+
+	// BackendEjected reports backends ejected by outlier detection
+	BackendEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_backend_ejected",
+		Help:      "Whether backend is ejected by passive outlier detection.",
+	}, []string{"upstream", "backend"})
+
+	// BackendEjections counts outlier ejections
+	BackendEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_backend_ejections_total",
+		Help:      "Number of times backend was ejected by passive outlier detection.",
+	}, []string{"upstream", "backend", "reason"})
+
+	// BackendActiveRequests reports in-flight requests per backend
+	BackendActiveRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_backend_active_requests",
+		Help:      "Number of requests currently processed by backend.",
+	}, []string{"upstream", "backend"})
+
+	// BackendRequests counts requests sent to backends
+	BackendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_backend_requests_total",
+		Help:      "Number of requests sent to backend by result (status code or error).",
+	}, []string{"upstream", "backend", "result"})
+)
+
+var (
+	// BreakerState reports circuit breaker state: 0 - closed, 1 - open, 2 - half-open
+	BreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state: 0 - closed, 1 - open, 2 - half-open.",
+	}, []string{"breaker"})
+
+	// BreakerRejected counts requests rejected by circuit breakers
+	BreakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_rejected_total",
+		Help:      "Number of requests rejected by circuit breaker.",
+	}, []string{"breaker", "reason"})
+)
+
+var (
+	// Tunnels counts tunnels requested by clients (HTTP CONNECT, SOCKS5)
+	Tunnels = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnels_total",
+		Help:      "Number of tunnels requested by clients by protocol and result.",
+	}, []string{"protocol", "result"})
+
+	// TunnelsActive reports established tunnels
+	TunnelsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tunnels_active",
+		Help:      "Number of currently established tunnels.",
+	}, []string{"protocol"})
+
+	// TunnelBytes counts data transferred through tunnels
+	TunnelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnel_bytes_total",
+		Help:      "Number of bytes transferred through tunnels: sent to destinations or received from them.",
+	}, []string{"protocol", "direction"})
+)
+
+var (
+	// AsyncCalls counts requests sent to async interceptors
+	AsyncCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interceptor_async_calls_total",
+		Help:      "Number of requests sent to async interceptors by result: ok or error.",
+	}, []string{"interceptor", "result"})
+
+	// AsyncDropped counts requests not sent to async interceptors because the queue is full
+	AsyncDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interceptor_async_dropped_total",
+		Help:      "Number of requests dropped because async queue is full or proxy is shutting down.",
+	}, []string{"interceptor"})
+
+	// DryRunDecisions counts answers of interceptors in dry run mode
+	DryRunDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interceptor_dry_run_decisions_total",
+		Help:      "Number of answers ignored in dry run mode by action (ignore, forward, response or error) and response status.",
+	}, []string{"interceptor", "action", "status"})
+
+	// AsyncQueued reports requests waiting to be sent to async interceptors
+	AsyncQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "interceptor_async_queued",
+		Help:      "Number of requests waiting to be sent to async interceptors.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		BackendHealthy,
+		BackendEjected,
+		BackendEjections,
+		BackendActiveRequests,
+		BackendRequests,
+		BreakerState,
+		BreakerRejected,
+		Tunnels,
+		TunnelsActive,
+		TunnelBytes,
+		AsyncCalls,
+		AsyncDropped,
+		AsyncQueued,
+		DryRunDecisions,
+	)
+}
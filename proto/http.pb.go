@@ -49,21 +49,24 @@ func (x OnRequestOutput_Action) String() string {
 	return proto.EnumName(OnRequestOutput_Action_name, int32(x))
 }
 func (OnRequestOutput_Action) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_http_258494afd7d63ce0, []int{1, 0}
+	return fileDescriptor_http_26864fef5b04ff25, []int{1, 0}
 }
 
 type OnRequestInput struct {
-	Req                  *HTTPRequest `protobuf:"bytes,1,opt,name=req,proto3" json:"req,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
-	XXX_unrecognized     []byte       `json:"-"`
-	XXX_sizecache        int32        `json:"-"`
+	Req    *HTTPRequest `protobuf:"bytes,1,opt,name=req,proto3" json:"req,omitempty"`
+	Client *ClientInfo  `protobuf:"bytes,2,opt,name=client,proto3" json:"client,omitempty"`
+	// arguments the rule specifies for the interceptor
+	Params               map[string]string `protobuf:"bytes,3,rep,name=params,proto3" json:"params,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *OnRequestInput) Reset()         { *m = OnRequestInput{} }
 func (m *OnRequestInput) String() string { return proto.CompactTextString(m) }
 func (*OnRequestInput) ProtoMessage()    {}
 func (*OnRequestInput) Descriptor() ([]byte, []int) {
-	return fileDescriptor_http_258494afd7d63ce0, []int{0}
+	return fileDescriptor_http_26864fef5b04ff25, []int{0}
 }
 func (m *OnRequestInput) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_OnRequestInput.Unmarshal(m, b)
@@ -90,6 +93,20 @@ func (m *OnRequestInput) GetReq() *HTTPRequest {
 	return nil
 }
 
+func (m *OnRequestInput) GetClient() *ClientInfo {
+	if m != nil {
+		return m.Client
+	}
+	return nil
+}
+
+func (m *OnRequestInput) GetParams() map[string]string {
+	if m != nil {
+		return m.Params
+	}
+	return nil
+}
+
 type OnRequestOutput struct {
 	Action               OnRequestOutput_Action `protobuf:"varint,1,opt,name=action,proto3,enum=proto.OnRequestOutput_Action" json:"action,omitempty"`
 	Req                  *HTTPRequest           `protobuf:"bytes,2,opt,name=req,proto3" json:"req,omitempty"`
@@ -103,7 +120,7 @@ func (m *OnRequestOutput) Reset()         { *m = OnRequestOutput{} }
 func (m *OnRequestOutput) String() string { return proto.CompactTextString(m) }
 func (*OnRequestOutput) ProtoMessage()    {}
 func (*OnRequestOutput) Descriptor() ([]byte, []int) {
-	return fileDescriptor_http_258494afd7d63ce0, []int{1}
+	return fileDescriptor_http_26864fef5b04ff25, []int{1}
 }
 func (m *OnRequestOutput) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_OnRequestOutput.Unmarshal(m, b)
@@ -158,7 +175,7 @@ func (m *HTTPRequest) Reset()         { *m = HTTPRequest{} }
 func (m *HTTPRequest) String() string { return proto.CompactTextString(m) }
 func (*HTTPRequest) ProtoMessage()    {}
 func (*HTTPRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_http_258494afd7d63ce0, []int{2}
+	return fileDescriptor_http_26864fef5b04ff25, []int{2}
 }
 func (m *HTTPRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_HTTPRequest.Unmarshal(m, b)
@@ -219,7 +236,7 @@ func (m *HTTPResponse) Reset()         { *m = HTTPResponse{} }
 func (m *HTTPResponse) String() string { return proto.CompactTextString(m) }
 func (*HTTPResponse) ProtoMessage()    {}
 func (*HTTPResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_http_258494afd7d63ce0, []int{3}
+	return fileDescriptor_http_26864fef5b04ff25, []int{3}
 }
 func (m *HTTPResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_HTTPResponse.Unmarshal(m, b)
@@ -260,13 +277,89 @@ func (m *HTTPResponse) GetBody() []byte {
 	return nil
 }
 
+type ClientInfo struct {
+	// remote address of the connection
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	// verified client certificate (mTLS), empty if not presented
+	CertSubject  string   `protobuf:"bytes,2,opt,name=certSubject,proto3" json:"certSubject,omitempty"`
+	CertDNSNames []string `protobuf:"bytes,3,rep,name=certDNSNames,proto3" json:"certDNSNames,omitempty"`
+	// hex-encoded SHA-256 fingerprint of the client certificate
+	CertFingerprint string `protobuf:"bytes,4,opt,name=certFingerprint,proto3" json:"certFingerprint,omitempty"`
+	// authenticated proxy user, empty if proxy authentication is disabled
+	User                 string   `protobuf:"bytes,5,opt,name=user,proto3" json:"user,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ClientInfo) Reset()         { *m = ClientInfo{} }
+func (m *ClientInfo) String() string { return proto.CompactTextString(m) }
+func (*ClientInfo) ProtoMessage()    {}
+func (*ClientInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_http_26864fef5b04ff25, []int{4}
+}
+func (m *ClientInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ClientInfo.Unmarshal(m, b)
+}
+func (m *ClientInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ClientInfo.Marshal(b, m, deterministic)
+}
+func (dst *ClientInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ClientInfo.Merge(dst, src)
+}
+func (m *ClientInfo) XXX_Size() int {
+	return xxx_messageInfo_ClientInfo.Size(m)
+}
+func (m *ClientInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_ClientInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ClientInfo proto.InternalMessageInfo
+
+func (m *ClientInfo) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *ClientInfo) GetCertSubject() string {
+	if m != nil {
+		return m.CertSubject
+	}
+	return ""
+}
+
+func (m *ClientInfo) GetCertDNSNames() []string {
+	if m != nil {
+		return m.CertDNSNames
+	}
+	return nil
+}
+
+func (m *ClientInfo) GetCertFingerprint() string {
+	if m != nil {
+		return m.CertFingerprint
+	}
+	return ""
+}
+
+func (m *ClientInfo) GetUser() string {
+	if m != nil {
+		return m.User
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*OnRequestInput)(nil), "proto.OnRequestInput")
+	proto.RegisterMapType((map[string]string)(nil), "proto.OnRequestInput.ParamsEntry")
 	proto.RegisterType((*OnRequestOutput)(nil), "proto.OnRequestOutput")
 	proto.RegisterType((*HTTPRequest)(nil), "proto.HTTPRequest")
 	proto.RegisterMapType((map[string]string)(nil), "proto.HTTPRequest.HeadersEntry")
 	proto.RegisterType((*HTTPResponse)(nil), "proto.HTTPResponse")
 	proto.RegisterMapType((map[string]string)(nil), "proto.HTTPResponse.HeadersEntry")
+	proto.RegisterType((*ClientInfo)(nil), "proto.ClientInfo")
 	proto.RegisterEnum("proto.OnRequestOutput_Action", OnRequestOutput_Action_name, OnRequestOutput_Action_value)
 }
 
@@ -342,32 +435,40 @@ var _Interceptor_serviceDesc = grpc.ServiceDesc{
 	Metadata: "http.proto",
 }
 
-func init() { proto.RegisterFile("http.proto", fileDescriptor_http_258494afd7d63ce0) }
-
-var fileDescriptor_http_258494afd7d63ce0 = []byte{
-	// 380 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x92, 0x51, 0x6b, 0xda, 0x50,
-	0x14, 0xc7, 0xbd, 0x89, 0xc6, 0x79, 0x92, 0xb9, 0x70, 0xb6, 0x49, 0x10, 0xc6, 0x42, 0xd8, 0xc0,
-	0xa7, 0x0c, 0x32, 0x36, 0x36, 0xd9, 0x8b, 0xb0, 0x6c, 0xca, 0x86, 0x91, 0xab, 0xa5, 0xcf, 0x51,
-	0x2f, 0x58, 0xda, 0x26, 0x31, 0xf7, 0xa6, 0xe0, 0xd7, 0xea, 0x47, 0xe8, 0x43, 0x3f, 0x57, 0xb9,
-	0x37, 0xd1, 0x5a, 0x2b, 0xed, 0x4b, 0x9f, 0x72, 0x0e, 0xf7, 0xf7, 0xcf, 0xf9, 0xdd, 0xcb, 0x01,
-	0x58, 0x09, 0x91, 0xf9, 0x59, 0x9e, 0x8a, 0x14, 0x1b, 0xea, 0xe3, 0x7d, 0x87, 0x76, 0x94, 0x50,
-	0xb6, 0x2e, 0x18, 0x17, 0xa3, 0x24, 0x2b, 0x04, 0x7e, 0x02, 0x3d, 0x67, 0x6b, 0x87, 0xb8, 0xa4,
-	0x67, 0x06, 0x58, 0xd2, 0xfe, 0x70, 0x36, 0x9b, 0x54, 0x14, 0x95, 0xc7, 0xde, 0x2d, 0x81, 0x37,
-	0xbb, 0x60, 0x54, 0x08, 0x99, 0xfc, 0x06, 0x46, 0xbc, 0x10, 0x67, 0x69, 0xa2, 0xc2, 0xed, 0xe0,
-	0x43, 0x15, 0x3e, 0xe0, 0xfc, 0x81, 0x82, 0x68, 0x05, 0x6f, 0x07, 0x6a, 0x4f, 0x0e, 0xc4, 0xcf,
-	0x92, 0xe2, 0x8e, 0xae, 0xa8, 0xb7, 0x0f, 0x28, 0x9e, 0xa5, 0x09, 0x67, 0x12, 0xe3, 0xde, 0x17,
-	0x30, 0xca, 0xdf, 0x23, 0x80, 0x31, 0xfa, 0x3b, 0x8e, 0x68, 0x68, 0xd7, 0xd0, 0x84, 0xe6, 0x9f,
-	0x88, 0x9e, 0x0e, 0xe8, 0x6f, 0x9b, 0xa0, 0x05, 0xaf, 0x68, 0x38, 0x9d, 0x44, 0xe3, 0x69, 0x68,
-	0x6b, 0xde, 0x0d, 0x01, 0x73, 0x6f, 0x18, 0x76, 0xc0, 0xb8, 0x64, 0x62, 0x95, 0x2e, 0xd5, 0x25,
-	0x5a, 0xb4, 0xea, 0xd0, 0x06, 0xfd, 0x84, 0xfe, 0x57, 0x96, 0x2d, 0x2a, 0x4b, 0xfc, 0x09, 0xcd,
-	0x15, 0x8b, 0x97, 0x2c, 0xe7, 0x4e, 0xdd, 0xd5, 0x7b, 0x66, 0xf0, 0xf1, 0xb1, 0xbb, 0x3f, 0x2c,
-	0x89, 0x30, 0x11, 0xf9, 0x86, 0x6e, 0x79, 0x44, 0xa8, 0xcf, 0xd3, 0xe5, 0xc6, 0x69, 0xb8, 0xa4,
-	0x67, 0x51, 0x55, 0x77, 0xfb, 0x60, 0xed, 0xc3, 0x72, 0xe0, 0x39, 0xdb, 0x54, 0x16, 0xb2, 0xc4,
-	0x77, 0xd0, 0xb8, 0x8a, 0x2f, 0x0a, 0x56, 0x49, 0x94, 0x4d, 0x5f, 0xfb, 0x41, 0xbc, 0x6b, 0x02,
-	0xd6, 0xfe, 0x5b, 0xc8, 0x5b, 0x70, 0x11, 0x8b, 0x82, 0xab, 0xfc, 0x6b, 0x5a, 0x75, 0xd8, 0xbf,
-	0x77, 0xd6, 0x94, 0xb3, 0x7b, 0xe4, 0x25, 0x9f, 0x91, 0xd6, 0x5f, 0x46, 0x3a, 0xf8, 0x07, 0xe6,
-	0x28, 0x11, 0x2c, 0x5f, 0xb0, 0x4c, 0xa4, 0x39, 0xfe, 0x82, 0xd6, 0x6e, 0x51, 0xf0, 0xfd, 0xe1,
-	0xea, 0xa8, 0xdd, 0xec, 0x76, 0x8e, 0x6f, 0x94, 0x57, 0x9b, 0x1b, 0xea, 0xe0, 0xeb, 0x5d, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0x49, 0xb2, 0xc3, 0xd0, 0xe3, 0x02, 0x00, 0x00,
+func init() { proto.RegisterFile("http.proto", fileDescriptor_http_26864fef5b04ff25) }
+
+var fileDescriptor_http_26864fef5b04ff25 = []byte{
+	// 507 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x93, 0xdf, 0x6e, 0xd3, 0x30,
+	0x14, 0xc6, 0xe7, 0xfe, 0x49, 0xe9, 0x49, 0xd9, 0xca, 0x01, 0xa6, 0xa8, 0x12, 0xa2, 0x44, 0x20,
+	0x95, 0x9b, 0x20, 0x15, 0x21, 0xd1, 0x8a, 0x9b, 0x89, 0x75, 0xac, 0x02, 0x35, 0x95, 0x3b, 0xc4,
+	0x75, 0x9a, 0x18, 0x5a, 0x58, 0x9d, 0xcc, 0x76, 0x90, 0xfa, 0x4a, 0x5c, 0xf2, 0x08, 0x5c, 0xf0,
+	0x0a, 0xbc, 0x0e, 0xb2, 0xe3, 0x6e, 0xe9, 0xa8, 0x40, 0x48, 0xbb, 0xca, 0x39, 0x27, 0x3f, 0x1f,
+	0x7f, 0xe7, 0xb3, 0x0d, 0xb0, 0x50, 0x2a, 0x0b, 0x32, 0x91, 0xaa, 0x14, 0xeb, 0xe6, 0xe3, 0xff,
+	0x22, 0xb0, 0x1f, 0x72, 0xca, 0x2e, 0x72, 0x26, 0xd5, 0x98, 0x67, 0xb9, 0xc2, 0xc7, 0x50, 0x15,
+	0xec, 0xc2, 0x23, 0x5d, 0xd2, 0x73, 0xfb, 0x58, 0xe0, 0xc1, 0xe9, 0xd9, 0xd9, 0xd4, 0x52, 0x54,
+	0xff, 0xc6, 0xa7, 0xe0, 0xc4, 0xe7, 0x4b, 0xc6, 0x95, 0x57, 0x31, 0xe0, 0x1d, 0x0b, 0xbe, 0x36,
+	0xc5, 0x31, 0xff, 0x98, 0x52, 0x0b, 0xe0, 0x00, 0x9c, 0x2c, 0x12, 0xd1, 0x4a, 0x7a, 0xd5, 0x6e,
+	0xb5, 0xe7, 0xf6, 0x1f, 0x59, 0x74, 0x7b, 0xdf, 0x60, 0x6a, 0x98, 0x11, 0x57, 0x62, 0x4d, 0xed,
+	0x82, 0xce, 0x00, 0xdc, 0x52, 0x19, 0xdb, 0x50, 0xfd, 0xc2, 0xd6, 0x46, 0x5a, 0x93, 0xea, 0x10,
+	0xef, 0x41, 0xfd, 0x6b, 0x74, 0x9e, 0x33, 0xa3, 0xa2, 0x49, 0x8b, 0x64, 0x58, 0x79, 0x49, 0xfc,
+	0x9f, 0x04, 0x0e, 0x2e, 0x77, 0x08, 0x73, 0xa5, 0x47, 0x7b, 0x01, 0x4e, 0x14, 0xab, 0x65, 0xca,
+	0x4d, 0x8b, 0xfd, 0xfe, 0x83, 0xeb, 0x4a, 0x0a, 0x2e, 0x38, 0x32, 0x10, 0xb5, 0xf0, 0xc6, 0x91,
+	0xca, 0xdf, 0x1d, 0x79, 0xa2, 0x29, 0x3d, 0xa3, 0xa6, 0xee, 0x6e, 0x51, 0x32, 0x4b, 0xb9, 0x64,
+	0x1a, 0x93, 0xfe, 0x33, 0x70, 0x8a, 0xf6, 0x08, 0xe0, 0x8c, 0xdf, 0x4c, 0x42, 0x3a, 0x6a, 0xef,
+	0xa1, 0x0b, 0x8d, 0x93, 0x90, 0x7e, 0x38, 0xa2, 0xc7, 0x6d, 0x82, 0x2d, 0xb8, 0x45, 0x47, 0xb3,
+	0x69, 0x38, 0x99, 0x8d, 0xda, 0x15, 0xff, 0x07, 0x01, 0xb7, 0xb4, 0x19, 0x1e, 0x82, 0xb3, 0x62,
+	0x6a, 0x91, 0x26, 0xd6, 0x07, 0x9b, 0x69, 0x73, 0xde, 0xd3, 0x77, 0xd6, 0x08, 0x1d, 0xe2, 0x00,
+	0x1a, 0x0b, 0x16, 0x25, 0x4c, 0x48, 0xaf, 0x66, 0x9c, 0x7f, 0xf8, 0xa7, 0xf6, 0xe0, 0xb4, 0x20,
+	0x0a, 0xdf, 0x37, 0x3c, 0x22, 0xd4, 0xe6, 0x69, 0xb2, 0xf6, 0xea, 0x5d, 0xd2, 0x6b, 0x51, 0x13,
+	0x77, 0x86, 0xd0, 0x2a, 0xc3, 0xff, 0x75, 0x1a, 0xdf, 0x09, 0xb4, 0xca, 0x5e, 0xe8, 0x29, 0xa4,
+	0x8a, 0x54, 0x2e, 0xcd, 0xfa, 0xdb, 0xd4, 0x66, 0x38, 0xbc, 0xd2, 0x5c, 0x31, 0x9a, 0xbb, 0x3b,
+	0x9c, 0xfc, 0x87, 0xe8, 0xea, 0x0d, 0x89, 0xfe, 0x46, 0x00, 0xae, 0xee, 0x33, 0x7a, 0xd0, 0x88,
+	0x92, 0x44, 0x30, 0x29, 0xed, 0xf2, 0x4d, 0x8a, 0x5d, 0x70, 0x63, 0x26, 0xd4, 0x2c, 0x9f, 0x7f,
+	0x66, 0xb1, 0xb2, 0x8d, 0xca, 0x25, 0xf4, 0xa1, 0xa5, 0xd3, 0xe3, 0xc9, 0x6c, 0x12, 0xad, 0x58,
+	0xf1, 0x12, 0x9a, 0x74, 0xab, 0x86, 0x3d, 0x38, 0xd0, 0xf9, 0xc9, 0x92, 0x7f, 0x62, 0x22, 0x13,
+	0x4b, 0xae, 0xbc, 0x9a, 0xe9, 0x74, 0xbd, 0xac, 0x07, 0xcd, 0x25, 0x13, 0xe6, 0x74, 0x9a, 0xd4,
+	0xc4, 0xfd, 0xb7, 0xe0, 0x8e, 0xb9, 0x62, 0x22, 0x66, 0x99, 0x4a, 0x05, 0xbe, 0x82, 0xe6, 0xe5,
+	0xad, 0xc6, 0xfb, 0x3b, 0x5f, 0x5c, 0xe7, 0x70, 0xf7, 0xf5, 0xf7, 0xf7, 0xe6, 0x8e, 0xf9, 0xf1,
+	0xfc, 0xf7, 0x00, 0xd0, 0x59, 0xeb, 0xfd, 0x32, 0x04, 0x00, 0x00,
 }
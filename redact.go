@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// redactingFormatter hides secret configuration values in log records
+type redactingFormatter struct {
+	logrus.Formatter
+	redact func(string) string
+}
+
+// redactLogs hides secrets in messages and fields of the logger
+func redactLogs(log *logger.Logger, redact func(string) string) {
+	log.SetFormatter(redactingFormatter{Formatter: log.Formatter, redact: redact})
+}
+
+func (f redactingFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	entry := *e
+	entry.Message = f.redact(e.Message)
+	entry.Data = make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = f.redact(v)
+		case error, fmt.Stringer:
+			entry.Data[k] = f.redact(fmt.Sprint(v))
+		default:
+			entry.Data[k] = v
+		}
+	}
+	return f.Formatter.Format(&entry)
+}
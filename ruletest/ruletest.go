@@ -0,0 +1,281 @@
+// Package ruletest runs sample requests through the rules and reports if outcomes match expected ones:
+// 	- requests are not sent to destinations, the proxy stops right before it
+// 	- gRPC interceptors are replaced with canned answers, built-in ones are called as usual
+package ruletest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/httpproxy"
+	"github.com/afoninsky/verdite/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// rule name of requests passed by default route
+const defaultRule = "default"
+
+// Suite describes sample requests and expected outcomes
+type Suite struct {
+	// answers of gRPC interceptors by name, stubs without answer fail
+	Stubs map[string]Stub `yaml:"stubs"`
+	Cases []Case          `yaml:"cases"`
+}
+
+// Stub describes canned answer of the interceptor
+type Stub struct {
+	// ignore (default), forward or response
+	Action   string                     `yaml:"action"`
+	Request  config.InterceptorRequest  `yaml:"request"`
+	Response config.InterceptorResponse `yaml:"response"`
+	// error returned instead of the answer
+	Error string `yaml:"error"`
+}
+
+// Case describes sample request and its expected outcome
+type Case struct {
+	Name    string  `yaml:"name"`
+	Request Request `yaml:"request"`
+	// overrides of suite stubs
+	Stubs  map[string]Stub `yaml:"stubs"`
+	Expect Expect          `yaml:"expect"`
+}
+
+// Request describes proxy request: absolute url for forwarded requests, host:port for CONNECT
+type Request struct {
+	// GET by default
+	Method  string            `yaml:"method"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// client address, 192.0.2.1:1234 by default
+	RemoteAddr string `yaml:"remoteAddr"`
+}
+
+// Expect describes outcome, unspecified fields are not checked
+type Expect struct {
+	// matched rule as "METHOD /path" or "default"
+	Rule string `yaml:"rule"`
+	// interceptors called in order
+	Chain []string `yaml:"chain"`
+	// forward or response
+	Action string `yaml:"action"`
+	// status of the response
+	Status int `yaml:"status"`
+	// destination url of the forwarded request
+	URL string `yaml:"url"`
+	// headers of the forwarded request or the response, empty value means header is absent
+	Headers map[string]string `yaml:"headers"`
+	// body of the forwarded request or the response
+	Body *string `yaml:"body"`
+}
+
+// Result describes checked case
+type Result struct {
+	Case  string
+	Trace *httpproxy.Trace
+	// mismatches of expected and actual outcome
+	Failures []string
+}
+
+// Passed checks if outcome matches expected one
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Load reads YAML or JSON file with cases
+func Load(path string) (*Suite, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var suite Suite
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&suite); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &suite, nil
+}
+
+// Run checks cases against configuration, upstream health checks are disabled
+func Run(cfg *config.Config, suite *Suite, log *logger.Logger) ([]Result, error) {
+	for name, u := range cfg.Upstreams {
+		u.HealthCheck = config.UpstreamHealthCheck{}
+		cfg.Upstreams[name] = u
+	}
+	proxy, err := httpproxy.New(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	defer proxy.Shutdown(context.Background())
+
+	// plugins are not contacted
+	plugins := []string{}
+	for name, i := range cfg.Interceptors {
+		if i.Type == "grpc" {
+			plugins = append(plugins, name)
+		}
+	}
+	sort.Strings(plugins)
+
+	results := make([]Result, 0, len(suite.Cases))
+	for i, c := range suite.Cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("case %d", i+1)
+		}
+		for _, plugin := range plugins {
+			s, ok := c.Stubs[plugin]
+			if !ok {
+				s, ok = suite.Stubs[plugin]
+			}
+			if !ok {
+				s = Stub{Error: fmt.Sprintf(`no stub for "%s" interceptor`, plugin)}
+			}
+			proxy.Stub(plugin, s)
+		}
+
+		r, err := c.Request.build()
+		if err != nil {
+			results = append(results, Result{Case: name, Failures: []string{err.Error()}})
+			continue
+		}
+		t := proxy.Simulate(r)
+		results = append(results, Result{Case: name, Trace: t, Failures: c.Expect.check(t)})
+	}
+	return results, nil
+}
+
+// OnRequest returns canned answer
+func (s Stub) OnRequest(ctx context.Context, in *proto.OnRequestInput) (*proto.OnRequestOutput, error) {
+	if s.Error != "" {
+		return nil, errors.New(s.Error)
+	}
+	switch strings.ToLower(s.Action) {
+	case "", "ignore":
+		return &proto.OnRequestOutput{Action: proto.OnRequestOutput_IGNORE}, nil
+	case "forward":
+		return &proto.OnRequestOutput{
+			Action: proto.OnRequestOutput_FORWARD,
+			Req: &proto.HTTPRequest{
+				Method:  s.Request.Method,
+				URL:     s.Request.URL,
+				Headers: s.Request.Headers,
+				Body:    []byte(s.Request.Body),
+			},
+		}, nil
+	case "response":
+		return &proto.OnRequestOutput{
+			Action: proto.OnRequestOutput_RESPONSE,
+			Res: &proto.HTTPResponse{
+				Status:  uint32(s.Response.Status),
+				Headers: s.Response.Headers,
+				Body:    []byte(s.Response.Body),
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf(`unknown stub action "%s"`, s.Action)
+}
+
+// Close ...
+func (s Stub) Close() error {
+	return nil
+}
+
+// build creates request as the proxy receives it
+func (r Request) build() (req *http.Request, err error) {
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	// httptest panics on malformed requests
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("invalid request: %v", p)
+		}
+	}()
+	req = httptest.NewRequest(method, r.URL, strings.NewReader(r.Body))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	if r.RemoteAddr != "" {
+		req.RemoteAddr = r.RemoteAddr
+	}
+	return req, nil
+}
+
+// check compares trace with expected outcome
+func (e Expect) check(t *httpproxy.Trace) []string {
+	failures := []string{}
+	mismatch := func(field string, expected, actual interface{}) {
+		failures = append(failures, fmt.Sprintf("%s: expected %q, got %q", field, expected, actual))
+	}
+
+	rule := t.Rule
+	if rule == "" {
+		rule = defaultRule
+	}
+	if e.Rule != "" && e.Rule != rule {
+		mismatch("rule", e.Rule, rule)
+	}
+	if e.Chain != nil {
+		chain := []string{}
+		for _, step := range t.Chain {
+			chain = append(chain, step.Interceptor)
+		}
+		if strings.Join(e.Chain, ",") != strings.Join(chain, ",") {
+			mismatch("chain", strings.Join(e.Chain, ", "), strings.Join(chain, ", "))
+		}
+	}
+	if e.Action != "" && e.Action != t.Action {
+		mismatch("action", e.Action, t.Action)
+	}
+
+	var header http.Header
+	var body []byte
+	if t.Action == httpproxy.ActionForward {
+		header = t.Request.Header
+		body, _ = ioutil.ReadAll(t.Request.Body)
+		if e.URL != "" && e.URL != t.Request.URL.String() {
+			mismatch("url", e.URL, t.Request.URL.String())
+		}
+		if e.Status != 0 {
+			failures = append(failures, fmt.Sprintf("status: expected %d, request is forwarded", e.Status))
+		}
+	} else {
+		header = t.Header
+		body = t.Body
+		if e.Status != 0 && e.Status != t.Status {
+			failures = append(failures, fmt.Sprintf("status: expected %d, got %d %s", e.Status, t.Status, strings.TrimSpace(string(t.Body))))
+		}
+		if e.URL != "" {
+			mismatch("url", e.URL, "")
+		}
+	}
+
+	names := make([]string, 0, len(e.Headers))
+	for name := range e.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if actual := header.Get(name); actual != e.Headers[name] {
+			mismatch("header "+http.CanonicalHeaderKey(name), e.Headers[name], actual)
+		}
+	}
+	if e.Body != nil && *e.Body != string(body) {
+		mismatch("body", *e.Body, string(body))
+	}
+	return failures
+}
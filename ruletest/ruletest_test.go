@@ -0,0 +1,213 @@
+package ruletest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/httpproxy"
+)
+
+// loadConfig writes configuration to temporary directory and loads it
+func loadConfig(t *testing.T, content string) *config.Config {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "verdite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(strings.TrimLeft(content, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRun(t *testing.T) {
+	cfg := loadConfig(t, `
+interceptors:
+  auth:
+    type: grpc
+    grpc:
+      address: 127.0.0.1:1
+  deny:
+    type: response
+    response:
+      status: 403
+rules:
+  - match:
+      method: GET
+      path: /private/*any
+    onRequest: [auth]
+  - match:
+      method: GET
+      path: /admin
+    onRequest: [deny]
+`)
+	body := "denied"
+	suite := &Suite{
+		Stubs: map[string]Stub{"auth": {Action: "forward", Request: config.InterceptorRequest{Headers: map[string]string{"X-User": "alice"}}}},
+		Cases: []Case{
+			{
+				Name:    "stub answer is used",
+				Request: Request{URL: "http://example.com/private/data"},
+				Expect: Expect{
+					Rule:    "GET /private/*any",
+					Chain:   []string{"auth"},
+					Action:  httpproxy.ActionForward,
+					URL:     "http://example.com/private/data",
+					Headers: map[string]string{"X-User": "alice"},
+				},
+			},
+			{
+				Request: Request{URL: "http://example.com/private/data"},
+				Stubs:   map[string]Stub{"auth": {Action: "response", Response: config.InterceptorResponse{Status: 401, Body: body}}},
+				Expect:  Expect{Action: httpproxy.ActionResponse, Status: 401, Body: &body},
+			},
+			{
+				Name:    "built-in interceptor is called",
+				Request: Request{URL: "http://example.com/admin"},
+				Expect:  Expect{Rule: "GET /admin", Chain: []string{"auth"}, Status: 200},
+			},
+			{
+				Name:    "invalid request",
+				Request: Request{Method: "GET /", URL: "http://example.com/"},
+			},
+		},
+	}
+
+	results, err := Run(cfg, suite, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := map[string][]string{}
+	for _, r := range results {
+		failures[r.Case] = r.Failures
+	}
+	// request is not sent, the failure describes why it can't be built
+	if invalid := failures["invalid request"]; len(invalid) != 1 || !strings.HasPrefix(invalid[0], "invalid request: ") {
+		t.Errorf("unexpected failures of invalid request: %q", invalid)
+	}
+	delete(failures, "invalid request")
+	expected := map[string][]string{
+		"stub answer is used": {},
+		"case 2":              {},
+		"built-in interceptor is called": {
+			`chain: expected "auth", got "deny"`,
+			"status: expected 200, got 403 ",
+		},
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Errorf("expected %q, got %q", expected, failures)
+	}
+}
+
+func TestExpectCheck(t *testing.T) {
+	forwarded := func() *httpproxy.Trace {
+		r := httptest.NewRequest(http.MethodPost, "http://backend.local/api", strings.NewReader("sent"))
+		r.Header.Set("X-User", "alice")
+		return &httpproxy.Trace{
+			Rule:    "POST /api",
+			Chain:   []httpproxy.TraceStep{{Interceptor: "auth"}, {Interceptor: "mark"}},
+			Action:  httpproxy.ActionForward,
+			Request: r,
+		}
+	}
+	responded := func() *httpproxy.Trace {
+		return &httpproxy.Trace{
+			Action: httpproxy.ActionResponse,
+			Status: 403,
+			Header: http.Header{"X-Reason": {"acl"}},
+			Body:   []byte("forbidden\n"),
+		}
+	}
+	body := "expected"
+	empty := ""
+
+	tests := []struct {
+		name     string
+		expect   Expect
+		trace    *httpproxy.Trace
+		failures []string
+	}{
+		{
+			name:     "matching forwarded request",
+			expect:   Expect{Rule: "POST /api", Chain: []string{"auth", "mark"}, Action: "forward", URL: "http://backend.local/api", Headers: map[string]string{"x-user": "alice", "X-Missing": ""}},
+			trace:    forwarded(),
+			failures: []string{},
+		},
+		{
+			name:     "unspecified fields are not checked",
+			expect:   Expect{},
+			trace:    responded(),
+			failures: []string{},
+		},
+		{
+			name:   "mismatching forwarded request",
+			expect: Expect{Rule: "default", Chain: []string{"auth"}, Action: "response", Status: 403, URL: "http://other.local/", Headers: map[string]string{"x-user": "bob"}, Body: &body},
+			trace:  forwarded(),
+			failures: []string{
+				`rule: expected "default", got "POST /api"`,
+				`chain: expected "auth", got "auth, mark"`,
+				`action: expected "response", got "forward"`,
+				`url: expected "http://other.local/", got "http://backend.local/api"`,
+				"status: expected 403, request is forwarded",
+				`header X-User: expected "bob", got "alice"`,
+				`body: expected "expected", got "sent"`,
+			},
+		},
+		{
+			name:   "mismatching response",
+			expect: Expect{Rule: "GET /", Chain: []string{}, Status: 401, URL: "http://backend.local/", Headers: map[string]string{"X-Reason": ""}, Body: &empty},
+			trace:  responded(),
+			failures: []string{
+				`rule: expected "GET /", got "default"`,
+				"status: expected 401, got 403 forbidden",
+				`url: expected "http://backend.local/", got ""`,
+				`header X-Reason: expected "", got "acl"`,
+				`body: expected "", got "forbidden\n"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if failures := tt.expect.check(tt.trace); !reflect.DeepEqual(failures, tt.failures) {
+				t.Errorf("expected %q, got %q", tt.failures, failures)
+			}
+		})
+	}
+}
+
+func TestExample(t *testing.T) {
+	cfg, err := config.New("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := Load("../examples/rules-test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := Run(cfg, suite, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(suite.Cases) {
+		t.Fatalf("expected %d results, got %d", len(suite.Cases), len(results))
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			t.Errorf("%s: %s", r.Case, strings.Join(r.Failures, ", "))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/afoninsky/utilities/pkg/logger"
+	"github.com/afoninsky/verdite/admin"
+	"github.com/afoninsky/verdite/certs"
+	"github.com/afoninsky/verdite/config"
+	"github.com/afoninsky/verdite/httpproxy"
+	"github.com/afoninsky/verdite/listeners"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const defaultDrainPeriod = 30 * time.Second
+
+// time given to connections accepted right before the handoff to send their requests
+const handoffGrace = time.Second
+
+// serve starts the proxy and blocks until it is shut down
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	listen := fs.String("listen", os.Getenv("LISTEN"), "proxy listener address overriding configuration (LISTEN)")
+	fs.Parse(args)
+
+	log := logger.New()
+
+	cfg, err := config.New(*cfgPath)
+	log.FatalIfErr(err)
+	redactLogs(log, cfg.Redact)
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if cfg.Listen == "" {
+		log.Fatal("proxy listener address is not specified")
+	}
+
+	proxy, err := httpproxy.New(cfg, log)
+	log.FatalIfErr(err)
+
+	// sockets are inherited from the previous process on upgrade or from systemd
+	sockets, err := listeners.New(log)
+	log.FatalIfErr(err)
+
+	errc := make(chan error, 3)
+
+	var adminServer *http.Server
+	if cfg.Admin.Listen != "" {
+		adminServer = &http.Server{
+			Handler: admin.New(proxy, cfg.Redact).Handler(),
+		}
+		l, err := sockets.Listen("admin", cfg.Admin.Listen)
+		log.FatalIfErr(err)
+		go func() {
+			log.WithField("address", cfg.Admin.Listen).Infoln("Admin server started")
+			if err := adminServer.Serve(l); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	}
+
+	var socksListener net.Listener
+	if cfg.Socks.Listen != "" {
+		socksListener, err = sockets.Listen("socks", cfg.Socks.Listen)
+		log.FatalIfErr(err)
+		go func() {
+			log.WithField("address", cfg.Socks.Listen).Infoln("SOCKS5 proxy server started")
+			errc <- proxy.ServeSOCKS(socksListener)
+		}()
+	}
+
+	h2s := &http2.Server{}
+	server := &http.Server{
+		// accept cleartext HTTP/2 (h2c) next to HTTP/1.x
+		Handler: h2c.NewHandler(proxy.Handler(), h2s),
+	}
+	l, err := sockets.Listen("http", cfg.Listen)
+	log.FatalIfErr(err)
+
+	if len(cfg.TLS.Certificates) == 0 {
+		log.FatalIfErr(http2.ConfigureServer(server, h2s))
+		go func() {
+			log.WithField("address", cfg.Listen).Infoln("HTTP proxy server started")
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	} else {
+		store, err := certs.New(cfg.TLS, log)
+		log.FatalIfErr(err)
+		server.TLSConfig = store.TLSConfig()
+		log.FatalIfErr(http2.ConfigureServer(server, h2s))
+		go func() {
+			log.WithField("address", cfg.Listen).Infoln("HTTPS proxy server started")
+			if err := server.ServeTLS(l, "", ""); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	}
+
+	// previous process lets go once this one serves traffic
+	log.FatalIfErr(sockets.Ready())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	upgraded := false
+wait:
+	for {
+		select {
+		case err := <-errc:
+			log.Fatal(err)
+		case sig := <-signals:
+			if sig != syscall.SIGUSR2 {
+				log.WithField("signal", sig.String()).Infoln("Shutting down")
+				break wait
+			}
+			// new process inherits listeners and validates config, this one keeps serving if it fails
+			log.Infoln("Upgrading")
+			if err := sockets.Upgrade(); err != nil {
+				log.WithError(err).Errorln("Upgrade failed, current process keeps serving")
+				continue
+			}
+			log.Infoln("Upgraded, shutting down")
+			upgraded = true
+			break wait
+		}
+	}
+
+	// fail readiness checks, stop accepting connections and wait for active requests and tunnels
+	proxy.Drain()
+	// load balancers notice failed readiness checks with a delay and keep sending new connections meanwhile,
+	// the new process accepts them after upgrade
+	if !upgraded && cfg.Shutdown.ReadinessDelay > 0 {
+		log.WithField("delay", cfg.Shutdown.ReadinessDelay.String()).Infoln("Waiting for readiness to propagate")
+		time.Sleep(cfg.Shutdown.ReadinessDelay)
+	}
+
+	drainPeriod := cfg.Shutdown.DrainPeriod
+	if drainPeriod <= 0 {
+		drainPeriod = defaultDrainPeriod
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainPeriod)
+	defer cancel()
+
+	// admin listener is shared with the new process, so readiness is reported by it
+	if upgraded && adminServer != nil {
+		adminServer.Close()
+	}
+	if socksListener != nil {
+		socksListener.Close()
+	}
+	// http.Server.Shutdown drops connections whose request is not read yet, so accepting is stopped beforehand;
+	// the new process accepts the rest of them from the shared socket
+	if upgraded {
+		l.Close()
+		time.Sleep(handoffGrace)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warnln("Active requests are interrupted")
+		server.Close()
+	}
+	// tunnels are hijacked from http server, so they are drained separately, plugins are closed afterwards
+	proxy.Shutdown(ctx)
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	log.Infoln("Proxy server stopped")
+}